@@ -0,0 +1,83 @@
+package im_search
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// BatchMode selects what a batch write does when one of its items fails.
+type BatchMode int
+
+const (
+	// AllOrNothing rolls the whole batch back on the first failing item.
+	AllOrNothing BatchMode = iota
+	// BestEffort undoes only the failing items and commits the others.
+	BestEffort
+)
+
+// ItemError is the failure of the item at Index of a batch.
+type ItemError struct {
+	Index int
+	Err   error
+}
+
+func (e ItemError) Error() string {
+	return fmt.Sprintf("item %d: %v", e.Index, e.Err)
+}
+
+func (e ItemError) Unwrap() error {
+	return e.Err
+}
+
+// BatchResult reports the outcome of a batch write.
+type BatchResult struct {
+	Written int         // items committed
+	Failed  []ItemError // in item order; AllOrNothing stops at the first
+}
+
+// writeBatch writes items in one transaction, preparing query once and calling write for
+// every item with the prepared statement. In AllOrNothing mode the first failure rolls the
+// batch back and is returned as an ItemError. In BestEffort mode every item runs inside a
+// savepoint, so a failing item leaves nothing behind, and the batch is committed with the
+// failures reported in BatchResult.Failed; the error is then only set when the transaction
+// itself fails.
+func writeBatch[T any](ctx context.Context, db *sql.DB, op, query string, items []T, mode BatchMode, write func(ctx context.Context, tx *sql.Tx, stmt *sql.Stmt, item T) error) (BatchResult, error) {
+	var res BatchResult
+	err := inTx(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+		stmt, err := tx.PrepareContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for i, item := range items {
+			if mode == AllOrNothing {
+				if err := write(ctx, tx, stmt, item); err != nil {
+					res.Failed = append(res.Failed, ItemError{Index: i, Err: opError(op, err)})
+					return res.Failed[0]
+				}
+				res.Written++
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, `SAVEPOINT batch_item;`); err != nil {
+				return err
+			}
+			if err := write(ctx, tx, stmt, item); err != nil {
+				res.Failed = append(res.Failed, ItemError{Index: i, Err: opError(op, err)})
+				if _, err := tx.ExecContext(ctx, `ROLLBACK TO batch_item;`); err != nil {
+					return err
+				}
+			} else {
+				res.Written++
+			}
+			if _, err := tx.ExecContext(ctx, `RELEASE batch_item;`); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		res.Written = 0
+	}
+	return res, opError(op, err)
+}
@@ -0,0 +1,71 @@
+package im_search
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestInsertContactsBatchModes(t *testing.T) {
+	contacts := []Contact{
+		{Uid: 2, Name: "bob"},
+		{Uid: 1, Name: "duplicate"},
+		{Uid: 3, Name: "carol"},
+	}
+	tests := []struct {
+		mode        BatchMode
+		wantErr     bool
+		wantWritten int
+		wantUids    []int
+	}{
+		{mode: AllOrNothing, wantErr: true, wantWritten: 0, wantUids: []int{1}},
+		{mode: BestEffort, wantErr: false, wantWritten: 2, wantUids: []int{1, 2, 3}},
+	}
+	for _, tt := range tests {
+		db := openTestDB(t)
+		if err := InsertContact(db, Contact{Uid: 1, Name: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+		res, err := InsertContacts(db, contacts, tt.mode)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("mode %d: InsertContacts error = %v, want error %v", tt.mode, err, tt.wantErr)
+		}
+		if err != nil && !errors.Is(err, ErrDuplicate) {
+			t.Errorf("mode %d: InsertContacts error = %v, want ErrDuplicate", tt.mode, err)
+		}
+		if res.Written != tt.wantWritten {
+			t.Errorf("mode %d: Written = %d, want %d", tt.mode, res.Written, tt.wantWritten)
+		}
+		if len(res.Failed) != 1 || res.Failed[0].Index != 1 || !errors.Is(res.Failed[0], ErrDuplicate) {
+			t.Errorf("mode %d: Failed = %v, want item 1 with ErrDuplicate", tt.mode, res.Failed)
+		}
+
+		var uids []int
+		rows, err := db.Query(`SELECT uid, name FROM contact ORDER BY uid;`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var c Contact
+			if err := rows.Scan(&c.Uid, &c.Name); err != nil {
+				t.Fatal(err)
+			}
+			if c.Uid == 1 && c.Name != "alice" {
+				t.Errorf("mode %d: contact 1 overwritten with %q", tt.mode, c.Name)
+			}
+			uids = append(uids, c.Uid)
+		}
+		rows.Close()
+		if !reflect.DeepEqual(uids, tt.wantUids) {
+			t.Errorf("mode %d: contacts %v, want %v", tt.mode, uids, tt.wantUids)
+		}
+		// The index follows the rows that were committed.
+		hits, err := SearchContactHits(db, "bob OR carol", HighlightOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hits) != len(tt.wantUids)-1 {
+			t.Errorf("mode %d: %d index hits for the batch, want %d", tt.mode, len(hits), len(tt.wantUids)-1)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package im_search
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Every test opens a database of its own, so its statements are not in the cache yet and
+// the budget runs out while they are prepared.
+
+func TestSearchBudgetTruncates(t *testing.T) {
+	db := openTestDB(t)
+	seed(t, db)
+	for i := 0; i < 2; i++ {
+		p, err := SearchContactPage(db, "zhang", DefaultHighlightOptions, SearchOptions{Limit: 10, Budget: time.Nanosecond})
+		if err != nil {
+			t.Fatalf("call %d: SearchContactPage error = %v, want a truncated page", i+1, err)
+		}
+		if !p.Truncated {
+			t.Errorf("call %d: Truncated = false, want true", i+1)
+		}
+	}
+}
+
+func TestSearchAllBudgetTruncates(t *testing.T) {
+	db := openTestDB(t)
+	seed(t, db)
+	res, err := SearchAll(db, "zhang", SearchAllOptions{Budget: time.Nanosecond})
+	if err != nil {
+		t.Fatalf("SearchAll error = %v, want truncated categories", err)
+	}
+	truncated := map[string]bool{
+		"contacts":      res.Contacts.Truncated,
+		"chat groups":   res.ChatGroups.Truncated,
+		"group members": res.GroupMembers.Truncated,
+		"chat messages": res.ChatMessages.Truncated,
+	}
+	for name, ok := range truncated {
+		if !ok {
+			t.Errorf("%s: Truncated = false, want true", name)
+		}
+	}
+}
+
+func TestSearchCancelledFails(t *testing.T) {
+	db := openTestDB(t)
+	seed(t, db)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p, err := SearchContactPageContext(ctx, db, "zhang", DefaultHighlightOptions, SearchOptions{Limit: 10, Budget: time.Minute})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("SearchContactPageContext error = %v, want context.Canceled", err)
+	}
+	if p.Truncated {
+		t.Error("Truncated = true for a cancelled search, want false")
+	}
+}
@@ -1,8 +1,8 @@
 package im_search
 
 import (
+	"context"
 	"database/sql"
-	"log"
 )
 
 type ChatGroup struct {
@@ -11,97 +11,173 @@ type ChatGroup struct {
 	Alias string
 }
 
-// CreateChatGroupTable creates the FTS5 virtual table if it doesn't exist.
+var chatGroupCollection = NewCollection(Collection[ChatGroup]{
+	Name:  "ChatGroup",
+	Table: "chat_group",
+	Columns: []Column{
+		{Name: "gid", Type: "INTEGER"},
+		{Name: "name", Type: "TEXT", Default: "''", Indexed: true, Pinyin: true, Weight: 10},
+		{Name: "alias", Type: "TEXT", Default: "''", Indexed: true, Weight: 5},
+	},
+	Key:    []string{"gid"},
+	Fields: func(g *ChatGroup) []any { return []any{&g.Gid, &g.Name, &g.Alias} },
+})
+
+// CreateChatGroupTable creates the chat_group table keyed by gid and its FTS5 index
+// chat_group_fts over name and alias if they don't exist, migrating a chat_group table
+// of the older standalone FTS5 layout. Migrate runs it as part of schema version 1.
 func CreateChatGroupTable(db *sql.DB) error {
-	createSQL := `CREATE VIRTUAL TABLE IF NOT EXISTS chat_group USING fts5(gid, name, alias, tokenize = 'simple 1');`
-	_, err := db.Exec(createSQL)
-	if err != nil {
-		log.Printf("CreateChatGroupTable error: %v", err)
-	}
-	return err
+	return CreateChatGroupTableContext(context.Background(), db)
 }
 
-// InsertChatGroup inserts a new chat group record.
+// CreateChatGroupTableContext is CreateChatGroupTable with a context.
+func CreateChatGroupTableContext(ctx context.Context, db *sql.DB) error {
+	return chatGroupCollection.CreateContext(ctx, db)
+}
+
+// InsertChatGroup inserts a new chat group record. It fails if gid already exists; use
+// UpsertChatGroup to replace it.
 func InsertChatGroup(db *sql.DB, g ChatGroup) error {
-	insertSQL := `INSERT INTO chat_group(gid, name, alias) VALUES (?, ?, ?);`
-	_, err := db.Exec(insertSQL, g.Gid, g.Name, g.Alias)
-	if err != nil {
-		log.Printf("InsertChatGroup error: %v", err)
-	}
-	return err
+	return InsertChatGroupContext(context.Background(), db, g)
+}
+
+// InsertChatGroupContext is InsertChatGroup with a context.
+func InsertChatGroupContext(ctx context.Context, db *sql.DB, g ChatGroup) error {
+	return chatGroupCollection.InsertContext(ctx, db, g)
+}
+
+// UpsertChatGroup inserts g, or updates the chat group with the same gid.
+func UpsertChatGroup(db *sql.DB, g ChatGroup) error {
+	return UpsertChatGroupContext(context.Background(), db, g)
+}
+
+// UpsertChatGroupContext is UpsertChatGroup with a context.
+func UpsertChatGroupContext(ctx context.Context, db *sql.DB, g ChatGroup) error {
+	return chatGroupCollection.UpsertContext(ctx, db, g)
+}
+
+// InsertChatGroups inserts groups like InsertChatGroup in one transaction.
+func InsertChatGroups(db *sql.DB, groups []ChatGroup, mode BatchMode) (BatchResult, error) {
+	return InsertChatGroupsContext(context.Background(), db, groups, mode)
+}
+
+// InsertChatGroupsContext is InsertChatGroups with a context.
+func InsertChatGroupsContext(ctx context.Context, db *sql.DB, groups []ChatGroup, mode BatchMode) (BatchResult, error) {
+	return chatGroupCollection.InsertAllContext(ctx, db, groups, mode)
+}
+
+// UpsertChatGroups upserts groups like UpsertChatGroup in one transaction.
+func UpsertChatGroups(db *sql.DB, groups []ChatGroup, mode BatchMode) (BatchResult, error) {
+	return UpsertChatGroupsContext(context.Background(), db, groups, mode)
+}
+
+// UpsertChatGroupsContext is UpsertChatGroups with a context.
+func UpsertChatGroupsContext(ctx context.Context, db *sql.DB, groups []ChatGroup, mode BatchMode) (BatchResult, error) {
+	return chatGroupCollection.UpsertAllContext(ctx, db, groups, mode)
 }
 
 // UpdateChatGroup updates name and alias for an existing gid.
 func UpdateChatGroup(db *sql.DB, g ChatGroup) error {
-	updateSQL := `UPDATE chat_group SET name = ?, alias = ? WHERE gid = ?;`
-	res, err := db.Exec(updateSQL, g.Name, g.Alias, g.Gid)
-	if err != nil {
-		log.Printf("UpdateChatGroup error: %v", err)
-		return err
-	}
-	affected, _ := res.RowsAffected()
-	if affected == 0 {
-		log.Printf("UpdateChatGroup: no rows updated for gid=%d", g.Gid)
-	}
-	return nil
+	return UpdateChatGroupContext(context.Background(), db, g)
+}
+
+// UpdateChatGroupContext is UpdateChatGroup with a context.
+func UpdateChatGroupContext(ctx context.Context, db *sql.DB, g ChatGroup) error {
+	return chatGroupCollection.UpdateContext(ctx, db, g)
 }
 
-// DeleteChatGroup removes a chat group by gid.
+// DeleteChatGroup removes a chat group by gid with its members and messages, as
+// DeleteChatGroupWith does with Cascade.
 func DeleteChatGroup(db *sql.DB, gid int) error {
-	deleteSQL := `DELETE FROM chat_group WHERE gid = ?;`
-	_, err := db.Exec(deleteSQL, gid)
-	if err != nil {
-		log.Printf("DeleteChatGroup error: %v", err)
-	}
-	return err
+	return DeleteChatGroupContext(context.Background(), db, gid)
+}
+
+// DeleteChatGroupContext is DeleteChatGroup with a context.
+func DeleteChatGroupContext(ctx context.Context, db *sql.DB, gid int) error {
+	return DeleteChatGroupWithContext(ctx, db, gid, DeleteOptions{Policy: Cascade})
+}
+
+// DeleteChatGroupWith removes a chat group by gid, and its members and messages as opts says.
+func DeleteChatGroupWith(db *sql.DB, gid int, opts DeleteOptions) error {
+	return DeleteChatGroupWithContext(context.Background(), db, gid, opts)
+}
+
+// DeleteChatGroupWithContext is DeleteChatGroupWith with a context.
+func DeleteChatGroupWithContext(ctx context.Context, db *sql.DB, gid int, opts DeleteOptions) error {
+	return opError("DeleteChatGroup", inTx(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+		return deleteSubject(ctx, tx, groupSubject, gid, opts.Policy)
+	}))
 }
 
 // GetChatGroup retrieves a single chat group by gid.
 func GetChatGroup(db *sql.DB, gid int) (ChatGroup, error) {
-	var g ChatGroup
-	query := `SELECT gid, name, alias FROM chat_group WHERE gid = ? LIMIT 1;`
-	row := db.QueryRow(query, gid)
-	err := row.Scan(&g.Gid, &g.Name, &g.Alias)
-	if err == sql.ErrNoRows {
-		return g, nil
-	}
-	if err != nil {
-		log.Printf("GetChatGroup error: %v", err)
-	}
-	return g, err
+	return GetChatGroupContext(context.Background(), db, gid)
+}
+
+// GetChatGroupContext is GetChatGroup with a context.
+func GetChatGroupContext(ctx context.Context, db *sql.DB, gid int) (ChatGroup, error) {
+	return chatGroupCollection.GetContext(ctx, db, gid)
+}
+
+// ChatGroupHit is a matched chat group with raw field values and the spans that matched.
+type ChatGroupHit struct {
+	ChatGroup
+	Spans       map[string][]Span // matched rune spans keyed by column: name, alias
+	Highlighted map[string]string // name and alias rendered with the call's HighlightOptions
+	Score       float64           // bm25 relevance with column weights; higher is better
 }
 
 // SearchChatGroups uses FTS5 MATCH to find matching chat groups.
 // Provide a raw FTS5 query like: "name:alice OR alias:bob" or simple term "alice".
+// Name and Alias come back with matches wrapped in '[' and ']'; use SearchChatGroupHits for spans.
 func SearchChatGroups(db *sql.DB, clause string) ([]ChatGroup, error) {
-	sqlStmt := "SELECT gid, simple_highlight(chat_group, 1, '[', ']') , simple_highlight(chat_group, 2, '[', ']') FROM chat_group WHERE (name MATCH ('" + clause + "')) OR (alias MATCH ('" + clause + "'));"
-	//log.Println(sqlStmt)
-	rows, err := db.Query(sqlStmt)
-	if err != nil {
-		log.Printf("SearchChatGroups query error: %v", err)
-		return nil, err
-	}
-	defer rows.Close()
+	return SearchChatGroupsContext(context.Background(), db, clause)
+}
 
+// SearchChatGroupsContext is SearchChatGroups with a context.
+func SearchChatGroupsContext(ctx context.Context, db *sql.DB, clause string) ([]ChatGroup, error) {
+	hits, err := SearchChatGroupHitsContext(ctx, db, clause, DefaultHighlightOptions)
 	var results []ChatGroup
-	for rows.Next() {
-		var g ChatGroup
-		if err := rows.Scan(&g.Gid, &g.Name, &g.Alias); err != nil {
-			log.Printf("SearchChatGroups scan error: %v", err)
-			continue
-		}
+	for _, h := range hits {
+		g := h.ChatGroup
+		g.Name, g.Alias = h.Highlighted["name"], h.Highlighted["alias"]
 		results = append(results, g)
 	}
-	if err := rows.Err(); err != nil {
-		log.Printf("SearchChatGroups rows error: %v", err)
-		return results, err
-	}
-	return results, nil
+	return results, err
+}
+
+// SearchChatGroupHits is like SearchChatGroups but keeps the raw values and reports matched spans.
+func SearchChatGroupHits(db *sql.DB, clause string, opts HighlightOptions) ([]ChatGroupHit, error) {
+	return SearchChatGroupHitsContext(context.Background(), db, clause, opts)
 }
 
-// SeedChatGroups inserts a small set of initial chat groups for examples and testing.
-// It is safe to call multiple times; errors on individual inserts are logged but not fatal.
+// SearchChatGroupHitsContext is SearchChatGroupHits with a context.
+func SearchChatGroupHitsContext(ctx context.Context, db *sql.DB, clause string, opts HighlightOptions) ([]ChatGroupHit, error) {
+	p, err := SearchChatGroupPageContext(ctx, db, clause, opts, SearchOptions{})
+	return p.Hits, err
+}
+
+// SearchChatGroupPage returns one page of SearchChatGroupHits.
+func SearchChatGroupPage(db *sql.DB, clause string, opts HighlightOptions, page SearchOptions) (Page[ChatGroupHit], error) {
+	return SearchChatGroupPageContext(context.Background(), db, clause, opts, page)
+}
+
+// SearchChatGroupPageContext is SearchChatGroupPage with a context.
+func SearchChatGroupPageContext(ctx context.Context, db *sql.DB, clause string, opts HighlightOptions, page SearchOptions) (Page[ChatGroupHit], error) {
+	p, err := chatGroupCollection.SearchContext(ctx, db, clause, opts, page)
+	return mapPage(p, func(h Hit[ChatGroup]) ChatGroupHit {
+		return ChatGroupHit{ChatGroup: h.Value, Spans: h.Spans, Highlighted: h.Highlighted, Score: h.Score}
+	}), err
+}
+
+// SeedChatGroups upserts a small set of initial chat groups for examples and testing.
+// It runs in one transaction and is idempotent; errors on individual upserts are logged to Logger but not fatal.
 func SeedChatGroups(db *sql.DB) error {
+	return SeedChatGroupsContext(context.Background(), db)
+}
+
+// SeedChatGroupsContext is SeedChatGroups with a context.
+func SeedChatGroupsContext(ctx context.Context, db *sql.DB) error {
 	groups := []ChatGroup{
 		{Gid: 1, Name: "开发组", Alias: "dev"},
 		{Gid: 2, Name: "产品讨论", Alias: "product"},
@@ -111,11 +187,11 @@ func SeedChatGroups(db *sql.DB) error {
 		{Gid: 1001, Name: "Friends", Alias: "friends"},
 	}
 
-	for _, g := range groups {
-		if err := InsertChatGroup(db, g); err != nil {
-			// Log and continue; seeding should not fail the whole app if one insert errors.
-			log.Printf("SeedChatGroups: failed to insert gid=%d name=%q alias=%q: %v", g.Gid, g.Name, g.Alias, err)
-		}
+	// Best effort; seeding should not fail the whole app if one upsert errors.
+	res, err := UpsertChatGroupsContext(ctx, db, groups, BestEffort)
+	for _, f := range res.Failed {
+		g := groups[f.Index]
+		logf("SeedChatGroups: failed to upsert gid=%d name=%q alias=%q: %v", g.Gid, g.Name, g.Alias, f.Err)
 	}
-	return nil
+	return err
 }
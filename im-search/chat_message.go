@@ -1,9 +1,10 @@
 package im_search
 
 import (
+	"context"
 	"database/sql"
-	"log"
 	"strings"
+	"time"
 )
 
 type ChatMessage struct {
@@ -11,131 +12,349 @@ type ChatMessage struct {
 	SubjectId   int
 	SubjectType string
 	Message     string
+	SenderUid   int
+	SentAt      int64 // unix milliseconds
+	MsgType     string
 }
 
-// CreateChatMessageTable creates the FTS5 virtual table if it doesn't exist.
+// Message types stored in msg_type.
+const (
+	MsgTypeText  = "text"
+	MsgTypeImage = "image"
+	MsgTypeFile  = "file"
+)
+
+var chatMessageCollection = NewCollection(Collection[ChatMessage]{
+	Name:  "ChatMessage",
+	Table: "chat_message",
+	Columns: []Column{
+		{Name: "cid", Type: "INTEGER"},
+		{Name: "subject_id", Type: "INTEGER"},
+		{Name: "subject_type", Type: "TEXT"},
+		{Name: "message", Type: "TEXT", Default: "''", Indexed: true, Weight: 1},
+		{Name: "sender_uid", Type: "INTEGER", Default: "0"},
+		{Name: "sent_at", Type: "INTEGER", Default: "0"},
+		{Name: "msg_type", Type: "TEXT", Default: "'" + MsgTypeText + "'"},
+	},
+	Key:        []string{"cid"},
+	Indexes:    []Index{{Name: "idx_chat_message_subject", Columns: []string{"subject_type", "subject_id", "sent_at"}}},
+	TimeColumn: "sent_at",
+	Fields: func(m *ChatMessage) []any {
+		return []any{&m.Cid, &m.SubjectId, &m.SubjectType, &m.Message, &m.SenderUid, &m.SentAt, &m.MsgType}
+	},
+	Defaults: func(m *ChatMessage) {
+		if m.SentAt == 0 {
+			m.SentAt = time.Now().UnixMilli()
+		}
+		if m.MsgType == "" {
+			m.MsgType = MsgTypeText
+		}
+	},
+	Defaulted: []string{"sent_at", "msg_type"},
+	AfterWrite: func(ctx context.Context, tx *sql.Tx, m ChatMessage) error {
+		return indexMentions(ctx, tx, m)
+	},
+	AfterDelete: func(ctx context.Context, tx *sql.Tx, key []any) error {
+		_, err := tx.ExecContext(ctx, `DELETE FROM chat_message_mention WHERE cid = ?;`, key...)
+		return err
+	},
+})
+
+// CreateChatMessageTable creates the chat_message table keyed by cid and its FTS5 index
+// chat_message_fts over message if they don't exist, plus the mention table. Messages are
+// also indexed by conversation and time. A chat_message table of the older standalone FTS5
+// layout is migrated; rows from before sender_uid, sent_at and msg_type existed get 0, 0
+// and MsgTypeText. Migrate runs it as part of schema version 1.
 func CreateChatMessageTable(db *sql.DB) error {
-	createSQL := `CREATE VIRTUAL TABLE IF NOT EXISTS chat_message USING fts5(cid, subject_id, subject_type, message, tokenize = 'simple 1');`
-	_, err := db.Exec(createSQL)
-	if err != nil {
-		log.Printf("CreateChatMessageTable error: %v", err)
+	return CreateChatMessageTableContext(context.Background(), db)
+}
+
+// CreateChatMessageTableContext is CreateChatMessageTable with a context.
+func CreateChatMessageTableContext(ctx context.Context, db *sql.DB) error {
+	return opError("CreateChatMessageTable", inTx(ctx, db, createChatMessageTable))
+}
+
+func createChatMessageTable(ctx context.Context, tx *sql.Tx) error {
+	if err := chatMessageCollection.create(ctx, tx); err != nil {
+		return err
 	}
-	return err
+	return createMentionTable(ctx, tx)
 }
 
-// InsertChatMessage inserts a new chat message record.
+// InsertChatMessage inserts a new chat message record and indexes its @mentions.
+// A zero SentAt is stored as the current time and an empty MsgType as MsgTypeText.
+// It fails if cid already exists; use UpsertChatMessage to replace it.
 func InsertChatMessage(db *sql.DB, m ChatMessage) error {
-	insertSQL := `INSERT INTO chat_message(cid, subject_id, subject_type, message) VALUES (?, ?, ?, ?);`
-	_, err := db.Exec(insertSQL, m.Cid, m.SubjectId, m.SubjectType, m.Message)
-	if err != nil {
-		log.Printf("InsertChatMessage error: %v", err)
-	}
-	return err
+	return InsertChatMessageContext(context.Background(), db, m)
+}
+
+// InsertChatMessageContext is InsertChatMessage with a context.
+func InsertChatMessageContext(ctx context.Context, db *sql.DB, m ChatMessage) error {
+	return chatMessageCollection.InsertContext(ctx, db, m)
+}
+
+// UpsertChatMessage inserts m like InsertChatMessage, or updates the message with the same cid.
+func UpsertChatMessage(db *sql.DB, m ChatMessage) error {
+	return UpsertChatMessageContext(context.Background(), db, m)
+}
+
+// UpsertChatMessageContext is UpsertChatMessage with a context.
+func UpsertChatMessageContext(ctx context.Context, db *sql.DB, m ChatMessage) error {
+	return chatMessageCollection.UpsertContext(ctx, db, m)
+}
+
+// InsertChatMessages inserts messages like InsertChatMessage in one transaction.
+func InsertChatMessages(db *sql.DB, messages []ChatMessage, mode BatchMode) (BatchResult, error) {
+	return InsertChatMessagesContext(context.Background(), db, messages, mode)
+}
+
+// InsertChatMessagesContext is InsertChatMessages with a context.
+func InsertChatMessagesContext(ctx context.Context, db *sql.DB, messages []ChatMessage, mode BatchMode) (BatchResult, error) {
+	return chatMessageCollection.InsertAllContext(ctx, db, messages, mode)
 }
 
-// UpdateChatMessage updates subject and message fields for an existing cid.
+// UpsertChatMessages upserts messages like UpsertChatMessage in one transaction.
+func UpsertChatMessages(db *sql.DB, messages []ChatMessage, mode BatchMode) (BatchResult, error) {
+	return UpsertChatMessagesContext(context.Background(), db, messages, mode)
+}
+
+// UpsertChatMessagesContext is UpsertChatMessages with a context.
+func UpsertChatMessagesContext(ctx context.Context, db *sql.DB, messages []ChatMessage, mode BatchMode) (BatchResult, error) {
+	return chatMessageCollection.UpsertAllContext(ctx, db, messages, mode)
+}
+
+// UpdateChatMessage updates subject, message and metadata fields for an existing cid
+// and re-indexes its @mentions. A zero SentAt or empty MsgType keeps the stored one.
 func UpdateChatMessage(db *sql.DB, m ChatMessage) error {
-	updateSQL := `UPDATE chat_message SET subject_id = ?, subject_type = ?, message = ? WHERE cid = ?;`
-	res, err := db.Exec(updateSQL, m.SubjectId, m.SubjectType, m.Message, m.Cid)
-	if err != nil {
-		log.Printf("UpdateChatMessage error: %v", err)
-		return err
-	}
-	affected, _ := res.RowsAffected()
-	if affected == 0 {
-		log.Printf("UpdateChatMessage: no rows updated for cid=%d", m.Cid)
-	}
-	return nil
+	return UpdateChatMessageContext(context.Background(), db, m)
+}
+
+// UpdateChatMessageContext is UpdateChatMessage with a context.
+func UpdateChatMessageContext(ctx context.Context, db *sql.DB, m ChatMessage) error {
+	return chatMessageCollection.UpdateContext(ctx, db, m)
 }
 
-// DeleteChatMessage removes a chat message by cid.
+// DeleteChatMessage removes a chat message and its mentions by cid.
 func DeleteChatMessage(db *sql.DB, cid int) error {
-	deleteSQL := `DELETE FROM chat_message WHERE cid = ?;`
-	_, err := db.Exec(deleteSQL, cid)
+	return DeleteChatMessageContext(context.Background(), db, cid)
+}
+
+// DeleteChatMessageContext is DeleteChatMessage with a context.
+func DeleteChatMessageContext(ctx context.Context, db *sql.DB, cid int) error {
+	return chatMessageCollection.DeleteContext(ctx, db, cid)
+}
+
+// inTx runs fn in a transaction, committing when it succeeds and rolling back otherwise.
+func inTx(ctx context.Context, db *sql.DB, fn func(ctx context.Context, tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		log.Printf("DeleteChatMessage error: %v", err)
+		return err
 	}
-	return err
+	if err := fn(ctx, tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
 
 // GetChatMessage retrieves a single chat message by cid.
 func GetChatMessage(db *sql.DB, cid int) (ChatMessage, error) {
-	var m ChatMessage
-	query := `SELECT cid, subject_id, subject_type, message FROM chat_message WHERE cid = ? LIMIT 1;`
-	row := db.QueryRow(query, cid)
-	err := row.Scan(&m.Cid, &m.SubjectId, &m.SubjectType, &m.Message)
-	if err == sql.ErrNoRows {
-		return m, nil
+	return GetChatMessageContext(context.Background(), db, cid)
+}
+
+// GetChatMessageContext is GetChatMessage with a context.
+func GetChatMessageContext(ctx context.Context, db *sql.DB, cid int) (ChatMessage, error) {
+	return chatMessageCollection.GetContext(ctx, db, cid)
+}
+
+// Conversation identifies a direct chat (SubjectType "contact", SubjectId the friend's uid)
+// or a group chat (SubjectType "group", SubjectId the gid).
+type Conversation struct {
+	SubjectType string
+	SubjectId   int
+}
+
+// MessageFilter restricts a message search. Empty fields do not restrict;
+// several values in one field match any of them.
+type MessageFilter struct {
+	Cids          []int
+	SenderUids    []int
+	MentionUids   []int // messages @mentioning any of these group members
+	Conversations []Conversation
+	Since         time.Time // inclusive
+	Until         time.Time // exclusive
+	MsgTypes      []string
+	// ViewerUid, when non-zero, keeps only the conversations ViewerUid belongs to: direct
+	// messages ViewerUid sent or that were sent to ViewerUid (subject_id), and messages of
+	// groups where group_member lists ViewerUid. It is enforced inside the SQL query.
+	ViewerUid int
+}
+
+// where returns the SQL condition of f and its arguments, or "" when f is empty.
+func (f MessageFilter) where() (string, []any) {
+	var conds []string
+	var args []any
+	if len(f.Cids) > 0 {
+		conds = append(conds, "cid IN (SELECT value FROM json_each(?))")
+		args = append(args, jsonList(f.Cids))
 	}
-	if err != nil {
-		log.Printf("GetChatMessage error: %v", err)
+	if f.ViewerUid != 0 {
+		conds = append(conds, "((subject_type = 'contact' AND (subject_id = ? OR sender_uid = ?)) OR (subject_type = 'group' AND subject_id IN (SELECT gid FROM group_member WHERE uid = ?)))")
+		args = append(args, f.ViewerUid, f.ViewerUid, f.ViewerUid)
 	}
-	return m, err
+	if len(f.SenderUids) > 0 {
+		conds = append(conds, "sender_uid IN (SELECT value FROM json_each(?))")
+		args = append(args, jsonList(f.SenderUids))
+	}
+	if len(f.MentionUids) > 0 {
+		conds = append(conds, "cid IN (SELECT cid FROM chat_message_mention WHERE uid IN (SELECT value FROM json_each(?)))")
+		args = append(args, jsonList(f.MentionUids))
+	}
+	if len(f.Conversations) > 0 {
+		pairs := make([][2]any, len(f.Conversations))
+		for i, c := range f.Conversations {
+			pairs[i] = [2]any{c.SubjectType, c.SubjectId}
+		}
+		conds = append(conds, "(subject_type, subject_id) IN (SELECT value ->> 0, value ->> 1 FROM json_each(?))")
+		args = append(args, jsonList(pairs))
+	}
+	if !f.Since.IsZero() {
+		conds = append(conds, "sent_at >= ?")
+		args = append(args, f.Since.UnixMilli())
+	}
+	if !f.Until.IsZero() {
+		conds = append(conds, "sent_at < ?")
+		args = append(args, f.Until.UnixMilli())
+	}
+	if len(f.MsgTypes) > 0 {
+		conds = append(conds, "msg_type IN (SELECT value FROM json_each(?))")
+		args = append(args, jsonList(f.MsgTypes))
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// placeholders returns n comma separated '?'.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
 }
 
+// ChatMessageHit is a matched chat message with the raw message and the spans that matched.
+type ChatMessageHit struct {
+	ChatMessage
+	Spans       map[string][]Span // matched rune spans keyed by column: message
+	Highlighted map[string]string // message rendered with the call's HighlightOptions
+	Score       float64           // bm25 relevance with column weights; higher is better
+	Snippet     string            // excerpt around the matches, set by SearchChatMessageSnippets
+}
+
+// SearchChatMessages finds messages containing every whitespace separated term of q.
+// Message comes back with matches wrapped in '[' and ']'; use SearchChatMessageHits for spans.
 func SearchChatMessages(db *sql.DB, q string) ([]ChatMessage, error) {
-	terms := strings.Fields(q)
-	if len(terms) == 0 {
-		return nil, nil
+	return SearchChatMessagesContext(context.Background(), db, q)
+}
+
+// SearchChatMessagesContext is SearchChatMessages with a context.
+func SearchChatMessagesContext(ctx context.Context, db *sql.DB, q string) ([]ChatMessage, error) {
+	hits, err := SearchChatMessageHitsContext(ctx, db, q, DefaultHighlightOptions)
+	var results []ChatMessage
+	for _, h := range hits {
+		m := h.ChatMessage
+		m.Message = h.Highlighted["message"]
+		results = append(results, m)
 	}
+	return results, err
+}
 
-	for i, t := range terms {
-		t = strings.TrimSpace(t)
-		if t == "" {
-			continue
+// SearchChatMessageHits is like SearchChatMessages but keeps the raw message and reports matched spans.
+func SearchChatMessageHits(db *sql.DB, q string, opts HighlightOptions) ([]ChatMessageHit, error) {
+	return SearchChatMessageHitsContext(context.Background(), db, q, opts)
+}
+
+// SearchChatMessageHitsContext is SearchChatMessageHits with a context.
+func SearchChatMessageHitsContext(ctx context.Context, db *sql.DB, q string, opts HighlightOptions) ([]ChatMessageHit, error) {
+	p, err := SearchChatMessagePageContext(ctx, db, q, opts, SearchOptions{})
+	return p.Hits, err
+}
+
+// SearchChatMessagePage returns one page of SearchChatMessageHits.
+func SearchChatMessagePage(db *sql.DB, q string, opts HighlightOptions, page SearchOptions) (Page[ChatMessageHit], error) {
+	return SearchChatMessagePageContext(context.Background(), db, q, opts, page)
+}
+
+// SearchChatMessagePageContext is SearchChatMessagePage with a context.
+func SearchChatMessagePageContext(ctx context.Context, db *sql.DB, q string, opts HighlightOptions, page SearchOptions) (Page[ChatMessageHit], error) {
+	return SearchChatMessagesFilteredContext(ctx, db, q, MessageFilter{}, opts, page)
+}
+
+// SearchChatMessagesFiltered returns one page of the messages containing every whitespace
+// separated term of q that also satisfy filter. With an empty q every message satisfying
+// filter is listed; sort those with ByTime, since without a query all scores are 0.
+func SearchChatMessagesFiltered(db *sql.DB, q string, filter MessageFilter, opts HighlightOptions, page SearchOptions) (Page[ChatMessageHit], error) {
+	return SearchChatMessagesFilteredContext(context.Background(), db, q, filter, opts, page)
+}
+
+// SearchChatMessagesFilteredContext is SearchChatMessagesFiltered with a context.
+func SearchChatMessagesFilteredContext(ctx context.Context, db *sql.DB, q string, filter MessageFilter, opts HighlightOptions, page SearchOptions) (Page[ChatMessageHit], error) {
+	clause := messageClause(q)
+	if clause == "" {
+		if where, _ := filter.where(); where == "" {
+			return Page[ChatMessageHit]{Total: -1}, nil
 		}
+	}
+	return searchChatMessagePage(ctx, db, clause, filter, opts, page)
+}
+
+// messageClause turns q into an FTS5 clause requiring every whitespace separated term as a phrase.
+func messageClause(q string) string {
+	terms := strings.Fields(q)
+	for i, t := range terms {
 		// Escape double quotes inside term and wrap in quotes for phrase search
 		t = strings.ReplaceAll(t, `"`, `""`)
 		terms[i] = `"` + t + `"`
 	}
+	return strings.Join(terms, " AND ")
+}
 
-	matchExpr := strings.Join(terms, " AND ")
-	sqlStmt := `SELECT cid, subject_id, subject_type, simple_highlight(chat_message, 3, '[', ']') FROM chat_message WHERE message MATCH ?;`
-	//log.Println(sqlStmt)
-	rows, err := db.Query(sqlStmt, matchExpr)
-	if err != nil {
-		log.Printf("SearchChatMessages query error: %v", err)
-		return nil, err
-	}
-	defer rows.Close()
-
-	var results []ChatMessage
-	for rows.Next() {
-		var m ChatMessage
-		if err := rows.Scan(&m.Cid, &m.SubjectId, &m.SubjectType, &m.Message); err != nil {
-			log.Printf("SearchChatMessages scan error: %v", err)
-			continue
-		}
-		results = append(results, m)
-	}
-	if err := rows.Err(); err != nil {
-		log.Printf("SearchChatMessages rows error: %v", err)
-		return results, err
-	}
-	return results, nil
+// searchChatMessagePage runs an FTS5 clause against the message column, restricted by filter.
+// An empty clause lists the messages satisfying filter.
+func searchChatMessagePage(ctx context.Context, db *sql.DB, clause string, filter MessageFilter, opts HighlightOptions, page SearchOptions) (Page[ChatMessageHit], error) {
+	where, args := filter.where()
+	p, err := chatMessageCollection.search(ctx, db, clause, where, args, opts, page)
+	return mapPage(p, func(h Hit[ChatMessage]) ChatMessageHit {
+		return ChatMessageHit{ChatMessage: h.Value, Spans: h.Spans, Highlighted: h.Highlighted, Score: h.Score}
+	}), err
 }
 
 // SeedChatMessages inserts example chat messages for both friend chats (subject_type="user")
-// and group chats (subject_type="group"). It is safe to call multiple times; individual
-// insert errors are logged but not fatal.
+// and group chats (subject_type="group"). It upserts in one transaction, so it is idempotent;
+// individual upsert errors are logged to Logger but not fatal.
 func SeedChatMessages(db *sql.DB) error {
+	return SeedChatMessagesContext(context.Background(), db)
+}
+
+// SeedChatMessagesContext is SeedChatMessages with a context.
+func SeedChatMessagesContext(ctx context.Context, db *sql.DB) error {
+	at := func(day, hour, minute int) int64 {
+		return time.Date(2026, time.March, day, hour, minute, 0, 0, time.Local).UnixMilli()
+	}
 	messages := []ChatMessage{
 		// Direct friend messages (subject_type = "contact"), subject_id is friend's uid
-		{Cid: 10001, SubjectId: 1001, SubjectType: "contact", Message: "你好，张三！最近怎么样？"},
-		{Cid: 10002, SubjectId: 1002, SubjectType: "contact", Message: "李四，明天一起吃饭吗？"},
-		{Cid: 10003, SubjectId: 1006, SubjectType: "contact", Message: "周杰伦的歌真好听。"},
+		{Cid: 10001, SubjectId: 1001, SubjectType: "contact", Message: "你好，张三！最近怎么样？", SenderUid: 1001, SentAt: at(2, 9, 30)},
+		{Cid: 10002, SubjectId: 1002, SubjectType: "contact", Message: "李四，明天一起吃饭吗？", SenderUid: 1002, SentAt: at(3, 18, 5)},
+		{Cid: 10003, SubjectId: 1006, SubjectType: "contact", Message: "周杰伦的歌真好听。", SenderUid: 1006, SentAt: at(5, 21, 40)},
 
-		// Group messages (subject_type = "group"), subject_id is gid
-		{Cid: 20001, SubjectId: 1, SubjectType: "group", Message: "大家好，今天的代码 review 安排在下午 3 点。"},
-		{Cid: 20002, SubjectId: 1, SubjectType: "group", Message: "请把你负责的模块 checklist 发一下。"},
-		{Cid: 20003, SubjectId: 2, SubjectType: "group", Message: "产品需求已经更新，请查看文档。"},
-		{Cid: 20004, SubjectId: 1001, SubjectType: "group", Message: "今晚聚餐地点：老地方。谁能来请回复。"},
+		// Group messages (subject_type = "group"), subject_id is gid, sender_uid a group member
+		{Cid: 20001, SubjectId: 1, SubjectType: "group", Message: "大家好，今天的代码 review 安排在下午 3 点。", SenderUid: 101, SentAt: at(2, 10, 0)},
+		{Cid: 20002, SubjectId: 1, SubjectType: "group", Message: "请把你负责的模块 checklist 发一下。", SenderUid: 102, SentAt: at(2, 10, 12)},
+		{Cid: 20003, SubjectId: 2, SubjectType: "group", Message: "产品需求已经更新，请查看文档。", SenderUid: 201, SentAt: at(4, 14, 20), MsgType: MsgTypeFile},
+		{Cid: 20004, SubjectId: 1001, SubjectType: "group", Message: "今晚聚餐地点：老地方。谁能来请回复。", SenderUid: 10001, SentAt: at(6, 17, 45)},
+		{Cid: 20005, SubjectId: 1, SubjectType: "group", Message: "@王强 review 的意见已经提交，请确认。", SenderUid: 101, SentAt: at(2, 16, 8)},
 	}
 
-	for _, m := range messages {
-		if err := InsertChatMessage(db, m); err != nil {
-			log.Printf("SeedChatMessages: failed to insert cid=%d subject=%d type=%s: %v", m.Cid, m.SubjectId, m.SubjectType, err)
-		}
+	res, err := UpsertChatMessagesContext(ctx, db, messages, BestEffort)
+	for _, f := range res.Failed {
+		m := messages[f.Index]
+		logf("SeedChatMessages: failed to upsert cid=%d subject=%d type=%s: %v", m.Cid, m.SubjectId, m.SubjectType, f.Err)
 	}
-	return nil
+	return err
 }
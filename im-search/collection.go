@@ -0,0 +1,516 @@
+package im_search
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Column declares one column of a Collection.
+type Column struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // SQL type: INTEGER, REAL or TEXT
+	// Default is the SQL literal the column defaults to, and the value given to rows of a
+	// legacy table lacking the column when it is migrated. Empty means no default.
+	Default string `json:"default,omitempty"`
+	// Indexed columns are tokenized by the FTS5 index; the field must be a string.
+	Indexed bool `json:"indexed,omitempty"`
+	// Pinyin marks Indexed columns holding names whose hanzi are highlighted by pinyin, see
+	// HighlightOptions.PinyinQuery.
+	Pinyin bool    `json:"pinyin,omitempty"`
+	Weight float64 `json:"weight,omitempty"` // default bm25 weight, see DefaultColumnWeights
+}
+
+// Index declares a secondary index of a Collection's base table.
+type Index struct {
+	Name    string   `json:"name"`
+	Columns []string `json:"columns"`
+}
+
+// Collection is a searchable entity T stored in a base table with an external-content
+// FTS5 index over its Indexed columns. A single INTEGER Key column is the rowid of the
+// index; any other Key gets a UNIQUE constraint and an id INTEGER PRIMARY KEY column
+// that only serves as the rowid.
+type Collection[T any] struct {
+	Name       string // Go name of T, used in log lines: InsertContact, SearchContacts
+	Table      string
+	Columns    []Column
+	Key        []string
+	Indexes    []Index
+	TimeColumn string // column ByTime orders by, optional; the field must be an int64
+	Tokenize   string // FTS5 tokenize option, "simple 1" when empty
+	// Fields returns pointers to the fields of v in Columns order.
+	Fields func(v *T) []any
+	// Defaults, if set, fills in unset fields before an insert or upsert.
+	Defaults func(v *T)
+	// Defaulted are the columns Defaults fills in. Update keeps their stored value where v
+	// leaves them zero.
+	Defaulted []string
+	// AfterWrite, if set, runs in the transaction of every insert, upsert and update.
+	AfterWrite func(ctx context.Context, tx *sql.Tx, v T) error
+	// AfterDelete, if set, runs in the transaction of every delete with the deleted key.
+	AfterDelete func(ctx context.Context, tx *sql.Tx, key []any) error
+}
+
+// Hit is a matched value with the spans that matched in its Indexed columns.
+type Hit[T any] struct {
+	Value       T
+	Spans       map[string][]Span // matched rune spans keyed by column
+	Highlighted map[string]string // Indexed columns rendered with the call's HighlightOptions
+	Score       float64           // bm25 relevance with column weights; higher is better
+}
+
+// NewCollection registers the table of c for searching and returns c. Collections are
+// declared once as package variables; registering a table twice panics.
+func NewCollection[T any](c Collection[T]) *Collection[T] {
+	r, err := newCollection(c)
+	if err != nil {
+		panic("im_search: " + err.Error())
+	}
+	return r
+}
+
+// newCollection is NewCollection failing when the table is registered already.
+func newCollection[T any](c Collection[T]) (*Collection[T], error) {
+	if err := register(c.Table, c.Columns, c.TimeColumn); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// register adds table to the registry, failing when a collection registered it already.
+func register(table string, columns []Column, timeColumn string) error {
+	registry.Lock()
+	defer registry.Unlock()
+	if isRegisteredLocked(table) {
+		return fmt.Errorf("collection %s: already exists", table)
+	}
+	names := make([]string, 0, len(columns))
+	weights := make(map[string]float64)
+	for _, col := range columns {
+		names = append(names, col.Name)
+		if col.Weight != 0 {
+			weights[col.Name] = col.Weight
+		}
+	}
+	tableColumns[table] = names
+	DefaultColumnWeights[table] = weights
+	if timeColumn != "" {
+		tableTimeColumn[table] = timeColumn
+	}
+	return nil
+}
+
+// Create creates the base table, its indexes and its FTS5 index if they don't exist,
+// migrating a legacy standalone FTS5 table of the same name.
+func (c *Collection[T]) Create(db *sql.DB) error {
+	return c.CreateContext(context.Background(), db)
+}
+
+// CreateContext is Create with a context.
+func (c *Collection[T]) CreateContext(ctx context.Context, db *sql.DB) error {
+	return opError("Create"+c.Name+"Table", inTx(ctx, db, c.create))
+}
+
+func (c *Collection[T]) create(ctx context.Context, tx *sql.Tx) error {
+	var defs []string
+	if c.rowid() == "id" {
+		defs = append(defs, "id INTEGER PRIMARY KEY")
+	}
+	legacyDefaults := make(map[string]string)
+	for _, col := range c.Columns {
+		def := col.Name + " " + col.Type
+		if col.Name == c.rowid() {
+			def += " PRIMARY KEY"
+		} else {
+			def += " NOT NULL"
+			if col.Default != "" {
+				def += " DEFAULT " + col.Default
+				legacyDefaults[col.Name] = col.Default
+			}
+		}
+		defs = append(defs, def)
+	}
+	if c.rowid() == "id" {
+		defs = append(defs, "UNIQUE ("+strings.Join(c.Key, ", ")+")")
+	}
+	stmts := []string{`CREATE TABLE IF NOT EXISTS ` + c.Table + `(` + strings.Join(defs, ", ") + `);`}
+	for _, idx := range c.Indexes {
+		stmts = append(stmts, `CREATE INDEX IF NOT EXISTS `+idx.Name+` ON `+c.Table+`(`+strings.Join(idx.Columns, ", ")+`);`)
+	}
+	var indexed []string
+	for _, col := range c.Columns {
+		if col.Indexed {
+			indexed = append(indexed, col.Name)
+		}
+	}
+	idx := ftsIndex{table: c.Table, rowid: c.rowid(), key: c.Key, indexed: indexed, tokenize: c.Tokenize, legacyDefaults: legacyDefaults}
+	return createIndexedTable(ctx, tx, idx, stmts...)
+}
+
+// rowid returns the column that is the rowid of the base table.
+func (c *Collection[T]) rowid() string {
+	if len(c.Key) == 1 {
+		for _, col := range c.Columns {
+			if col.Name == c.Key[0] && col.Type == "INTEGER" {
+				return col.Name
+			}
+		}
+	}
+	return "id"
+}
+
+// Insert inserts v. It fails with ErrDuplicate if the key of v already exists; use Upsert
+// to replace it.
+func (c *Collection[T]) Insert(db *sql.DB, v T) error {
+	return c.InsertContext(context.Background(), db, v)
+}
+
+// InsertContext is Insert with a context.
+func (c *Collection[T]) InsertContext(ctx context.Context, db *sql.DB, v T) error {
+	return opError("Insert"+c.Name, c.writeOne(ctx, db, c.insertSQL(), v))
+}
+
+// Upsert inserts v, or updates the row with the same key.
+func (c *Collection[T]) Upsert(db *sql.DB, v T) error {
+	return c.UpsertContext(context.Background(), db, v)
+}
+
+// UpsertContext is Upsert with a context.
+func (c *Collection[T]) UpsertContext(ctx context.Context, db *sql.DB, v T) error {
+	return opError("Upsert"+c.Name, c.writeOne(ctx, db, c.upsertSQL(), v))
+}
+
+// InsertAll inserts values like Insert in one transaction.
+func (c *Collection[T]) InsertAll(db *sql.DB, values []T, mode BatchMode) (BatchResult, error) {
+	return c.InsertAllContext(context.Background(), db, values, mode)
+}
+
+// InsertAllContext is InsertAll with a context.
+func (c *Collection[T]) InsertAllContext(ctx context.Context, db *sql.DB, values []T, mode BatchMode) (BatchResult, error) {
+	return writeBatch(ctx, db, "Insert"+c.Name+"s", c.insertSQL(), values, mode, c.write)
+}
+
+// UpsertAll upserts values like Upsert in one transaction.
+func (c *Collection[T]) UpsertAll(db *sql.DB, values []T, mode BatchMode) (BatchResult, error) {
+	return c.UpsertAllContext(context.Background(), db, values, mode)
+}
+
+// UpsertAllContext is UpsertAll with a context.
+func (c *Collection[T]) UpsertAllContext(ctx context.Context, db *sql.DB, values []T, mode BatchMode) (BatchResult, error) {
+	return writeBatch(ctx, db, "Upsert"+c.Name+"s", c.upsertSQL(), values, mode, c.write)
+}
+
+// writeOne runs write for the statement query in a transaction of its own.
+func (c *Collection[T]) writeOne(ctx context.Context, db *sql.DB, query string, v T) error {
+	return inTx(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+		stmt, err := tx.PrepareContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		return c.write(ctx, tx, stmt, v)
+	})
+}
+
+// write runs the insert statement stmt with the fields of v, after Defaults and before AfterWrite.
+func (c *Collection[T]) write(ctx context.Context, tx *sql.Tx, stmt *sql.Stmt, v T) error {
+	if c.Defaults != nil {
+		c.Defaults(&v)
+	}
+	if _, err := stmt.ExecContext(ctx, fieldValues(c.Fields(&v))...); err != nil {
+		return err
+	}
+	if c.AfterWrite != nil {
+		return c.AfterWrite(ctx, tx, v)
+	}
+	return nil
+}
+
+func (c *Collection[T]) insertSQL() string {
+	cols := columnsOf(c.Table)
+	return `INSERT INTO ` + c.Table + `(` + strings.Join(cols, ", ") + `) VALUES (` + placeholders(len(cols)) + `);`
+}
+
+func (c *Collection[T]) upsertSQL() string {
+	var set []string
+	for _, col := range c.valueColumns() {
+		set = append(set, col+" = excluded."+col)
+	}
+	return strings.TrimSuffix(c.insertSQL(), ";") + ` ON CONFLICT(` + strings.Join(c.Key, ", ") + `) DO UPDATE SET ` + strings.Join(set, ", ") + `;`
+}
+
+// Update updates the columns of the row with the key of v. It fails with ErrNotFound if
+// there is no such row.
+func (c *Collection[T]) Update(db *sql.DB, v T) error {
+	return c.UpdateContext(context.Background(), db, v)
+}
+
+// UpdateContext is Update with a context.
+func (c *Collection[T]) UpdateContext(ctx context.Context, db *sql.DB, v T) error {
+	return c.update(ctx, db, v, c.valueColumns())
+}
+
+// update sets columns of the row with the key of v to their values in v. With no columns it
+// only checks that the row exists.
+func (c *Collection[T]) update(ctx context.Context, db *sql.DB, v T, columns []string) error {
+	var set []string
+	for _, col := range columns {
+		set = append(set, col+" = "+c.updateValue(col))
+	}
+	if len(set) == 0 {
+		set = append(set, c.Key[0]+" = "+c.Key[0])
+	}
+	updateSQL := `UPDATE ` + c.Table + ` SET ` + strings.Join(set, ", ") + ` WHERE ` + c.keyWhere() + `;`
+	values := c.columnValues(v)
+	var args []any
+	for _, col := range columns {
+		args = append(args, values[col])
+	}
+	for _, col := range c.Key {
+		args = append(args, values[col])
+	}
+
+	var affected int64
+	err := inTx(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, updateSQL, args...)
+		if err != nil {
+			return err
+		}
+		affected, _ = res.RowsAffected()
+		if c.AfterWrite != nil && affected > 0 {
+			return c.AfterWrite(ctx, tx, v)
+		}
+		return nil
+	})
+	if err == nil && affected == 0 {
+		err = c.notFound(c.keyValues(v))
+	}
+	return opError("Update"+c.Name, err)
+}
+
+// Delete removes the row with key, given in Key order. It fails with ErrNotFound if there
+// is no such row.
+func (c *Collection[T]) Delete(db *sql.DB, key ...any) error {
+	return c.DeleteContext(context.Background(), db, key...)
+}
+
+// DeleteContext is Delete with a context.
+func (c *Collection[T]) DeleteContext(ctx context.Context, db *sql.DB, key ...any) error {
+	err := inTx(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `DELETE FROM `+c.Table+` WHERE `+c.keyWhere()+`;`, key...)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return c.notFound(key)
+		}
+		if c.AfterDelete != nil {
+			return c.AfterDelete(ctx, tx, key)
+		}
+		return nil
+	})
+	return opError("Delete"+c.Name, err)
+}
+
+// Get retrieves the row with key, given in Key order. It fails with ErrNotFound if there
+// is no such row.
+func (c *Collection[T]) Get(db *sql.DB, key ...any) (T, error) {
+	return c.GetContext(context.Background(), db, key...)
+}
+
+// GetContext is Get with a context.
+func (c *Collection[T]) GetContext(ctx context.Context, db *sql.DB, key ...any) (T, error) {
+	var v T
+	query := `SELECT ` + strings.Join(columnsOf(c.Table), ", ") + ` FROM ` + c.Table + ` WHERE ` + c.keyWhere() + ` LIMIT 1;`
+	err := db.QueryRowContext(ctx, query, key...).Scan(c.Fields(&v)...)
+	if err == sql.ErrNoRows {
+		err = c.notFound(key)
+	}
+	return v, opError("Get"+c.Name, err)
+}
+
+// Search returns one page of the values whose Indexed columns match the FTS5 clause.
+// The clause is bound as a parameter, so it can never change the SQL statement itself.
+func (c *Collection[T]) Search(db *sql.DB, clause string, opts HighlightOptions, page SearchOptions) (Page[Hit[T]], error) {
+	return c.SearchContext(context.Background(), db, clause, opts, page)
+}
+
+// SearchContext is Search with a context. Cancelling ctx interrupts the running statement.
+func (c *Collection[T]) SearchContext(ctx context.Context, db *sql.DB, clause string, opts HighlightOptions, page SearchOptions) (Page[Hit[T]], error) {
+	return c.search(ctx, db, clause, "", nil, opts, page)
+}
+
+// search is Search restricted by the SQL condition filter. An empty clause lists the
+// rows satisfying filter, with the raw values standing in for highlights.
+func (c *Collection[T]) search(ctx context.Context, db *sql.DB, clause, filter string, filterArgs []any, opts HighlightOptions, page SearchOptions) (Page[Hit[T]], error) {
+	q := searchQuery{op: "Search" + c.Name + "s", table: c.Table, filter: filter, filterArgs: filterArgs}
+	var indexed []string
+	pinyin := make(map[string]bool)
+	columns := columnsOf(c.Table)
+	selected := append([]string(nil), columns...)
+	for i, col := range c.Columns {
+		if !col.Indexed {
+			continue
+		}
+		indexed = append(indexed, col.Name)
+		pinyin[col.Name] = col.Pinyin
+		// simple_highlight needs a MATCH; without one the raw column stands in for it.
+		if clause != "" {
+			selected = append(selected, highlightColumn(c.Table, i))
+		} else {
+			selected = append(selected, col.Name)
+		}
+	}
+	if clause != "" {
+		q.match, q.matchArgs = columnMatch(c.Table, indexed, clause)
+	}
+	q.columns = strings.Join(selected, ", ")
+
+	return searchPage(ctx, db, q, page, func(rows *sql.Rows, key *pageKey) (Hit[T], error) {
+		var h Hit[T]
+		fields := c.Fields(&h.Value)
+		marked := make([]string, len(indexed))
+		dest := []any{&key.Rowid, &key.Score}
+		dest = append(dest, fields...)
+		for i := range marked {
+			dest = append(dest, &marked[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return h, err
+		}
+		raw := make([]string, 0, len(indexed))
+		for i, col := range c.Columns {
+			if col.Indexed {
+				raw = append(raw, fieldString(fields[i]))
+			}
+			if col.Name == c.TimeColumn {
+				key.Time = fieldInt64(fields[i])
+			}
+		}
+		h.Spans, h.Highlighted = highlightFields(indexed, pinyin, raw, marked, opts)
+		h.Score = -key.Score
+		return h, nil
+	})
+}
+
+// valueColumns returns the columns not in Key.
+func (c *Collection[T]) valueColumns() []string {
+	var cols []string
+	for _, col := range columnsOf(c.Table) {
+		if !c.isKey(col) {
+			cols = append(cols, col)
+		}
+	}
+	return cols
+}
+
+// updateValue returns the SQL value an update binds for col: the bound value, or the stored
+// one when col is Defaulted and the bound value is zero.
+func (c *Collection[T]) updateValue(col string) string {
+	for _, d := range c.Defaulted {
+		if d != col {
+			continue
+		}
+		zero := "''"
+		for _, def := range c.Columns {
+			if def.Name == col && (def.Type == "INTEGER" || def.Type == "REAL") {
+				zero = "0"
+			}
+		}
+		return "coalesce(nullif(?, " + zero + "), " + col + ")"
+	}
+	return "?"
+}
+
+func (c *Collection[T]) isKey(col string) bool {
+	for _, k := range c.Key {
+		if k == col {
+			return true
+		}
+	}
+	return false
+}
+
+// keyWhere returns "k1 = ? AND k2 = ?" for the Key columns.
+func (c *Collection[T]) keyWhere() string {
+	conds := make([]string, len(c.Key))
+	for i, k := range c.Key {
+		conds[i] = k + " = ?"
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// columnValues returns the field values of v by column name.
+func (c *Collection[T]) columnValues(v T) map[string]any {
+	values := fieldValues(c.Fields(&v))
+	m := make(map[string]any, len(values))
+	for i, col := range columnsOf(c.Table) {
+		m[col] = values[i]
+	}
+	return m
+}
+
+func (c *Collection[T]) keyValues(v T) []any {
+	values := c.columnValues(v)
+	key := make([]any, len(c.Key))
+	for i, k := range c.Key {
+		key[i] = values[k]
+	}
+	return key
+}
+
+// notFound returns the ErrNotFound error of the row with key.
+func (c *Collection[T]) notFound(key []any) error {
+	return fmt.Errorf("%s %s %w", c.Table, c.describeKey(key), ErrNotFound)
+}
+
+// describeKey formats key for errors, e.g. "gid=1 uid=101".
+func (c *Collection[T]) describeKey(key []any) string {
+	parts := make([]string, len(key))
+	for i, v := range key {
+		parts[i] = fmt.Sprintf("%s=%v", c.Key[i], v)
+	}
+	return strings.Join(parts, " ")
+}
+
+// fieldString returns the text a Fields pointer refers to, which is a *string or, for a
+// Document, an *any.
+func fieldString(p any) string {
+	switch p := p.(type) {
+	case *string:
+		return *p
+	case *any:
+		switch v := (*p).(type) {
+		case string:
+			return v
+		case []byte:
+			return string(v)
+		}
+	}
+	return ""
+}
+
+// fieldInt64 returns the integer a Fields pointer refers to, which is an *int64 or an *any.
+func fieldInt64(p any) int64 {
+	switch p := p.(type) {
+	case *int64:
+		return *p
+	case *any:
+		if v, ok := (*p).(int64); ok {
+			return v
+		}
+	}
+	return 0
+}
+
+// fieldValues dereferences the field pointers returned by Collection.Fields.
+func fieldValues(fields []any) []any {
+	values := make([]any, len(fields))
+	for i, f := range fields {
+		values[i] = reflect.ValueOf(f).Elem().Interface()
+	}
+	return values
+}
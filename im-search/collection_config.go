@@ -0,0 +1,208 @@
+package im_search
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// CollectionConfig declares a DocumentCollection, typically in a collections config file.
+type CollectionConfig struct {
+	Name       string   `json:"name"` // table name
+	Key        []string `json:"key"`
+	Columns    []Column `json:"columns"`
+	Indexes    []Index  `json:"indexes,omitempty"`
+	TimeColumn string   `json:"time_column,omitempty"`
+	Tokenize   string   `json:"tokenize,omitempty"` // FTS5 tokenize option, "simple 1" when empty
+}
+
+// CollectionsConfig is the content of a collections config file:
+//
+//	{"collections": [{"name": "note", "key": ["nid"], "columns": [
+//		{"name": "nid", "type": "INTEGER"},
+//		{"name": "title", "type": "TEXT", "default": "''", "indexed": true, "pinyin": true, "weight": 10}
+//	]}]}
+type CollectionsConfig struct {
+	Collections []CollectionConfig `json:"collections"`
+}
+
+var (
+	identPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	// internalPattern matches the names of the tables im_search creates itself besides the
+	// base tables of collections: FTS5 indexes and their shadow tables, vocabularies and
+	// SQLite's own tables.
+	internalPattern = regexp.MustCompile(`(?i)^sqlite_|_fts$|_fts_(data|idx|content|docsize|config)$|_vocab$`)
+	defaultPattern  = regexp.MustCompile(`^(-?[0-9]+(\.[0-9]+)?|'[^']*')$`)
+	tokenizePattern = regexp.MustCompile(`^[A-Za-z0-9_ ]+$`)
+)
+
+// internalTables are the tables and indexes im_search creates that no collection declares.
+var internalTables = map[string]bool{
+	"chat_message_mention": true, "trash": true,
+	"idx_chat_message_mention_uid": true, "idx_trash_subject": true,
+	"idx_chat_message_subject": true, "idx_group_member_uid": true,
+}
+
+// reservedWords are the SQLite keywords, the names FTS5 reserves for columns or reads as
+// operators in column filters, and the column aliases of search queries. None can name a
+// table, column or index, as identifiers are not quoted in the SQL built from them.
+var reservedWords = func() map[string]bool {
+	words := strings.Fields(`ABORT ACTION ADD AFTER ALL ALTER ALWAYS ANALYZE AND AS ASC ATTACH
+		AUTOINCREMENT BEFORE BEGIN BETWEEN BY CASCADE CASE CAST CHECK COLLATE COLUMN COMMIT
+		CONFLICT CONSTRAINT CREATE CROSS CURRENT CURRENT_DATE CURRENT_TIME CURRENT_TIMESTAMP
+		DATABASE DEFAULT DEFERRABLE DEFERRED DELETE DESC DETACH DISTINCT DO DROP EACH ELSE END
+		ESCAPE EXCEPT EXCLUDE EXCLUSIVE EXISTS EXPLAIN FAIL FILTER FIRST FOLLOWING FOR FOREIGN
+		FROM FULL GENERATED GLOB GROUP GROUPS HAVING IF IGNORE IMMEDIATE IN INDEX INDEXED
+		INITIALLY INNER INSERT INSTEAD INTERSECT INTO IS ISNULL JOIN KEY LAST LEFT LIKE LIMIT
+		MATCH MATERIALIZED NATURAL NO NOT NOTHING NOTNULL NULL NULLS OF OFFSET ON OR ORDER
+		OTHERS OUTER OVER PARTITION PLAN PRAGMA PRECEDING PRIMARY QUERY RAISE RANGE RECURSIVE
+		REFERENCES REGEXP REINDEX RELEASE RENAME REPLACE RESTRICT RETURNING RIGHT ROLLBACK ROW
+		ROWS SAVEPOINT SELECT SET TABLE TEMP TEMPORARY THEN TIES TO TRANSACTION TRIGGER
+		UNBOUNDED UNION UNIQUE UPDATE USING VACUUM VALUES VIEW VIRTUAL WHEN WHERE WINDOW WITH
+		WITHOUT
+		NEAR RANK ROWID OID _ROWID_
+		RID SCORE`)
+	m := make(map[string]bool, len(words))
+	for _, w := range words {
+		m[w] = true
+	}
+	return m
+}()
+
+// checkIdent reports why name cannot be used as an identifier, or nil.
+func checkIdent(name string) error {
+	switch {
+	case !identPattern.MatchString(name):
+		return fmt.Errorf("invalid name %q", name)
+	case reservedWords[strings.ToUpper(name)]:
+		return fmt.Errorf("%q is a reserved word", name)
+	}
+	return nil
+}
+
+// LoadCollections reads the collections config file at path and registers its collections.
+// The tables are not created; call Create on each collection.
+func LoadCollections(path string) ([]*DocumentCollection, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCollections(data)
+}
+
+// ParseCollections is LoadCollections for the content of a collections config file. Unknown
+// fields are rejected so that typos don't silently change a collection. Collections are
+// registered in order, up to the first invalid one.
+func ParseCollections(data []byte) ([]*DocumentCollection, error) {
+	var cfg CollectionsConfig
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("collections config: %w", err)
+	}
+	collections := make([]*DocumentCollection, 0, len(cfg.Collections))
+	for _, c := range cfg.Collections {
+		d, err := NewDocumentCollection(c)
+		if err != nil {
+			return collections, err
+		}
+		collections = append(collections, d)
+	}
+	return collections, nil
+}
+
+// validate checks that cfg only holds identifiers and literals that are safe to build
+// SQL from, and describes a searchable collection not registered yet.
+func (cfg CollectionConfig) validate() error {
+	fail := func(format string, args ...any) error {
+		return fmt.Errorf("collection %s: "+format, append([]any{cfg.Name}, args...)...)
+	}
+	if err := checkIdent(cfg.Name); err != nil {
+		return fmt.Errorf("collection %q: %w", cfg.Name, err)
+	}
+	if internalTables[strings.ToLower(cfg.Name)] || internalPattern.MatchString(cfg.Name) {
+		return fail("name is reserved for im_search tables")
+	}
+	if isRegistered(cfg.Name) {
+		return fail("already exists")
+	}
+	if cfg.Tokenize != "" && !tokenizePattern.MatchString(cfg.Tokenize) {
+		return fail("invalid tokenize %q", cfg.Tokenize)
+	}
+	columns := make(map[string]Column, len(cfg.Columns))
+	names := make(map[string]bool, len(cfg.Columns)) // SQLite names are case-insensitive
+	indexed := false
+	for _, col := range cfg.Columns {
+		if err := checkIdent(col.Name); err != nil {
+			return fail("column: %v", err)
+		}
+		if names[strings.ToLower(col.Name)] {
+			return fail("duplicate column %s", col.Name)
+		}
+		names[strings.ToLower(col.Name)] = true
+		columns[col.Name] = col
+		switch col.Type {
+		case "INTEGER", "REAL", "TEXT":
+		default:
+			return fail("column %s has invalid type %q", col.Name, col.Type)
+		}
+		if col.Default != "" && !defaultPattern.MatchString(col.Default) {
+			return fail("column %s has invalid default %q", col.Name, col.Default)
+		}
+		if col.Indexed && col.Type != "TEXT" {
+			return fail("indexed column %s must be TEXT", col.Name)
+		}
+		if col.Pinyin && !col.Indexed {
+			return fail("pinyin column %s must be indexed", col.Name)
+		}
+		indexed = indexed || col.Indexed
+	}
+	if !indexed {
+		return fail("no indexed column")
+	}
+	if len(cfg.Key) == 0 {
+		return fail("no key")
+	}
+	for _, k := range cfg.Key {
+		if _, ok := columns[k]; !ok {
+			return fail("unknown key column %s", k)
+		}
+	}
+	if names["id"] && !(len(cfg.Key) == 1 && columns[cfg.Key[0]].Type == "INTEGER") {
+		return fail("column id is reserved for the rowid of a composite or non-INTEGER key")
+	}
+	if cfg.TimeColumn != "" && columns[cfg.TimeColumn].Type != "INTEGER" {
+		return fail("time column %s must be an INTEGER column", cfg.TimeColumn)
+	}
+	for _, idx := range cfg.Indexes {
+		if err := checkIdent(idx.Name); err != nil {
+			return fail("index: %v", err)
+		}
+		if internalTables[strings.ToLower(idx.Name)] || internalPattern.MatchString(idx.Name) {
+			return fail("index name %s is reserved for im_search", idx.Name)
+		}
+		if len(idx.Columns) == 0 {
+			return fail("index %s has no columns", idx.Name)
+		}
+		for _, c := range idx.Columns {
+			if _, ok := columns[c]; !ok {
+				return fail("index %s has unknown column %s", idx.Name, c)
+			}
+		}
+	}
+	return nil
+}
+
+// goName returns the CamelCase of the table name t, used in log lines like a Go type name.
+func goName(t string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(t, "_") {
+		if part != "" {
+			b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	return b.String()
+}
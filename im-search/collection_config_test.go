@@ -0,0 +1,44 @@
+package im_search
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCollectionConfigRejectsReservedNames(t *testing.T) {
+	valid := func() CollectionConfig {
+		return CollectionConfig{
+			Name: "note",
+			Key:  []string{"nid"},
+			Columns: []Column{
+				{Name: "nid", Type: "INTEGER"},
+				{Name: "title", Type: "TEXT", Indexed: true},
+			},
+		}
+	}
+	if err := valid().validate(); err != nil {
+		t.Fatalf("valid config: %v", err)
+	}
+
+	for _, name := range []string{"trash", "chat_message_mention", "contact", "Contact", "contact_fts", "note_fts_data", "chat_message_vocab", "sqlite_sequence", "order"} {
+		cfg := valid()
+		cfg.Name = name
+		if err := cfg.validate(); err == nil {
+			t.Errorf("collection named %q accepted", name)
+		}
+	}
+	for _, name := range []string{"order", "group", "rank", "rowid", "score", "NEAR", "Title"} {
+		cfg := valid()
+		cfg.Columns = append(cfg.Columns, Column{Name: name, Type: "TEXT"})
+		if err := cfg.validate(); err == nil {
+			t.Errorf("column named %q accepted", name)
+		}
+	}
+	for _, name := range []string{"idx_trash_subject", "idx_chat_message_subject", "IDX_GROUP_MEMBER_UID", "index", "note_fts"} {
+		cfg := valid()
+		cfg.Indexes = []Index{{Name: name, Columns: []string{"title"}}}
+		if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), "note") {
+			t.Errorf("index named %q: err = %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package im_search
+
+import "testing"
+
+func TestUpdateKeepsDefaultedColumns(t *testing.T) {
+	db := openTestDB(t)
+	if err := InsertChatMessage(db, ChatMessage{Cid: 1, SubjectType: "contact", SubjectId: 1, Message: "hello", SentAt: 1000, MsgType: MsgTypeImage}); err != nil {
+		t.Fatal(err)
+	}
+	get := func() ChatMessage {
+		t.Helper()
+		m, err := GetChatMessage(db, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	if err := UpdateChatMessage(db, ChatMessage{Cid: 1, SubjectType: "contact", SubjectId: 1, Message: "hello again"}); err != nil {
+		t.Fatal(err)
+	}
+	want := ChatMessage{Cid: 1, SubjectType: "contact", SubjectId: 1, Message: "hello again", SentAt: 1000, MsgType: MsgTypeImage}
+	if got := get(); got != want {
+		t.Errorf("after update without SentAt and MsgType = %+v, want %+v", got, want)
+	}
+
+	if err := UpdateChatMessage(db, ChatMessage{Cid: 1, SubjectType: "contact", SubjectId: 1, Message: "hello again", SentAt: 2000, MsgType: MsgTypeFile}); err != nil {
+		t.Fatal(err)
+	}
+	want.SentAt, want.MsgType = 2000, MsgTypeFile
+	if got := get(); got != want {
+		t.Errorf("after update with SentAt and MsgType = %+v, want %+v", got, want)
+	}
+}
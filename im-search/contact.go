@@ -1,8 +1,8 @@
 package im_search
 
 import (
+	"context"
 	"database/sql"
-	"log"
 )
 
 type Contact struct {
@@ -11,97 +11,178 @@ type Contact struct {
 	Alias string
 }
 
-// CreateContactTable creates the FTS5 virtual table if it doesn't exist.
+var contactCollection = NewCollection(Collection[Contact]{
+	Name:  "Contact",
+	Table: "contact",
+	Columns: []Column{
+		{Name: "uid", Type: "INTEGER"},
+		{Name: "name", Type: "TEXT", Default: "''", Indexed: true, Pinyin: true, Weight: 10},
+		{Name: "alias", Type: "TEXT", Default: "''", Indexed: true, Weight: 5},
+	},
+	Key:    []string{"uid"},
+	Fields: func(c *Contact) []any { return []any{&c.Uid, &c.Name, &c.Alias} },
+	AfterWrite: func(ctx context.Context, tx *sql.Tx, c Contact) error {
+		return propagateContact(ctx, tx, c)
+	},
+})
+
+// CreateContactTable creates the contact table keyed by uid and its FTS5 index contact_fts
+// over name and alias if they don't exist, migrating a contact table of the older
+// standalone FTS5 layout. Migrate runs it as part of schema version 1.
 func CreateContactTable(db *sql.DB) error {
-	createSQL := `CREATE VIRTUAL TABLE IF NOT EXISTS contact USING fts5(uid, name, alias, tokenize = 'simple 1');`
-	_, err := db.Exec(createSQL)
-	if err != nil {
-		log.Printf("CreateContactTable error: %v", err)
-	}
-	return err
+	return CreateContactTableContext(context.Background(), db)
 }
 
-// InsertContact inserts a new contact record.
+// CreateContactTableContext is CreateContactTable with a context.
+func CreateContactTableContext(ctx context.Context, db *sql.DB) error {
+	return contactCollection.CreateContext(ctx, db)
+}
+
+// InsertContact inserts a new contact record. It fails if uid already exists; use
+// UpsertContact to replace it.
 func InsertContact(db *sql.DB, c Contact) error {
-	insertSQL := `INSERT INTO contact(uid, name, alias) VALUES (?, ?, ?);`
-	_, err := db.Exec(insertSQL, c.Uid, c.Name, c.Alias)
-	if err != nil {
-		log.Printf("InsertContact error: %v", err)
-	}
-	return err
+	return InsertContactContext(context.Background(), db, c)
 }
 
-// UpdateContact updates name and alias for an existing uid.
+// InsertContactContext is InsertContact with a context.
+func InsertContactContext(ctx context.Context, db *sql.DB, c Contact) error {
+	return contactCollection.InsertContext(ctx, db, c)
+}
+
+// UpsertContact inserts c, or updates the contact with the same uid.
+func UpsertContact(db *sql.DB, c Contact) error {
+	return UpsertContactContext(context.Background(), db, c)
+}
+
+// UpsertContactContext is UpsertContact with a context.
+func UpsertContactContext(ctx context.Context, db *sql.DB, c Contact) error {
+	return contactCollection.UpsertContext(ctx, db, c)
+}
+
+// InsertContacts inserts contacts like InsertContact in one transaction.
+func InsertContacts(db *sql.DB, contacts []Contact, mode BatchMode) (BatchResult, error) {
+	return InsertContactsContext(context.Background(), db, contacts, mode)
+}
+
+// InsertContactsContext is InsertContacts with a context.
+func InsertContactsContext(ctx context.Context, db *sql.DB, contacts []Contact, mode BatchMode) (BatchResult, error) {
+	return contactCollection.InsertAllContext(ctx, db, contacts, mode)
+}
+
+// UpsertContacts upserts contacts like UpsertContact in one transaction.
+func UpsertContacts(db *sql.DB, contacts []Contact, mode BatchMode) (BatchResult, error) {
+	return UpsertContactsContext(context.Background(), db, contacts, mode)
+}
+
+// UpsertContactsContext is UpsertContacts with a context.
+func UpsertContactsContext(ctx context.Context, db *sql.DB, contacts []Contact, mode BatchMode) (BatchResult, error) {
+	return contactCollection.UpsertAllContext(ctx, db, contacts, mode)
+}
+
+// UpdateContact updates name and alias for an existing uid, and the copies of them in the
+// group_member rows of uid.
 func UpdateContact(db *sql.DB, c Contact) error {
-	updateSQL := `UPDATE contact SET name = ?, alias = ? WHERE uid = ?;`
-	res, err := db.Exec(updateSQL, c.Name, c.Alias, c.Uid)
-	if err != nil {
-		log.Printf("UpdateContact error: %v", err)
-		return err
-	}
-	affected, _ := res.RowsAffected()
-	if affected == 0 {
-		log.Printf("UpdateContact: no rows updated for uid=%d", c.Uid)
-	}
-	return nil
+	return UpdateContactContext(context.Background(), db, c)
+}
+
+// UpdateContactContext is UpdateContact with a context.
+func UpdateContactContext(ctx context.Context, db *sql.DB, c Contact) error {
+	return contactCollection.UpdateContext(ctx, db, c)
 }
 
-// DeleteContact removes a contact by uid.
+// DeleteContact removes a contact by uid with its group memberships and the messages of
+// the direct chat with it, as DeleteContactWith does with Cascade.
 func DeleteContact(db *sql.DB, uid int) error {
-	deleteSQL := `DELETE FROM contact WHERE uid = ?;`
-	_, err := db.Exec(deleteSQL, uid)
-	if err != nil {
-		log.Printf("DeleteContact error: %v", err)
-	}
-	return err
+	return DeleteContactContext(context.Background(), db, uid)
+}
+
+// DeleteContactContext is DeleteContact with a context.
+func DeleteContactContext(ctx context.Context, db *sql.DB, uid int) error {
+	return DeleteContactWithContext(ctx, db, uid, DeleteOptions{Policy: Cascade})
+}
+
+// DeleteContactWith removes a contact by uid, and its group memberships and messages as opts
+// says.
+func DeleteContactWith(db *sql.DB, uid int, opts DeleteOptions) error {
+	return DeleteContactWithContext(context.Background(), db, uid, opts)
+}
+
+// DeleteContactWithContext is DeleteContactWith with a context.
+func DeleteContactWithContext(ctx context.Context, db *sql.DB, uid int, opts DeleteOptions) error {
+	return opError("DeleteContact", inTx(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+		return deleteSubject(ctx, tx, contactSubject(opts), uid, opts.Policy)
+	}))
 }
 
 // GetContact retrieves a single contact by uid.
 func GetContact(db *sql.DB, uid int) (Contact, error) {
-	var c Contact
-	query := `SELECT uid, name, alias FROM contact WHERE uid = ? LIMIT 1;`
-	row := db.QueryRow(query, uid)
-	err := row.Scan(&c.Uid, &c.Name, &c.Alias)
-	if err == sql.ErrNoRows {
-		return c, nil
-	}
-	if err != nil {
-		log.Printf("GetContact error: %v", err)
-	}
-	return c, err
+	return GetContactContext(context.Background(), db, uid)
+}
+
+// GetContactContext is GetContact with a context.
+func GetContactContext(ctx context.Context, db *sql.DB, uid int) (Contact, error) {
+	return contactCollection.GetContext(ctx, db, uid)
+}
+
+// ContactHit is a matched contact with raw field values and the spans that matched.
+type ContactHit struct {
+	Contact
+	Spans       map[string][]Span // matched rune spans keyed by column: name, alias
+	Highlighted map[string]string // name and alias rendered with the call's HighlightOptions
+	Score       float64           // bm25 relevance with column weights; higher is better
 }
 
 // SearchContacts uses FTS5 MATCH to find matching contacts.
 // Provide a raw FTS5 query like: "name:alice OR alias:bob" or simple term "alice".
+// Name and Alias come back with matches wrapped in '[' and ']'; use SearchContactHits for spans.
 func SearchContacts(db *sql.DB, clause string) ([]Contact, error) {
-	sqlStmt := "SELECT uid, simple_highlight(contact, 1, '[', ']') , simple_highlight(contact, 2, '[', ']') FROM contact WHERE (name MATCH ('" + clause + "')) OR (alias MATCH ('" + clause + "'));"
-	//log.Println(sqlStmt)
-	rows, err := db.Query(sqlStmt)
-	if err != nil {
-		log.Printf("SearchContacts query error: %v", err)
-		return nil, err
-	}
-	defer rows.Close()
+	return SearchContactsContext(context.Background(), db, clause)
+}
 
+// SearchContactsContext is SearchContacts with a context.
+func SearchContactsContext(ctx context.Context, db *sql.DB, clause string) ([]Contact, error) {
+	hits, err := SearchContactHitsContext(ctx, db, clause, DefaultHighlightOptions)
 	var results []Contact
-	for rows.Next() {
-		var c Contact
-		if err := rows.Scan(&c.Uid, &c.Name, &c.Alias); err != nil {
-			log.Printf("SearchContacts scan error: %v", err)
-			continue
-		}
+	for _, h := range hits {
+		c := h.Contact
+		c.Name, c.Alias = h.Highlighted["name"], h.Highlighted["alias"]
 		results = append(results, c)
 	}
-	if err := rows.Err(); err != nil {
-		log.Printf("SearchContacts rows error: %v", err)
-		return results, err
-	}
-	return results, nil
+	return results, err
+}
+
+// SearchContactHits is like SearchContacts but keeps the raw values and reports matched spans.
+func SearchContactHits(db *sql.DB, clause string, opts HighlightOptions) ([]ContactHit, error) {
+	return SearchContactHitsContext(context.Background(), db, clause, opts)
 }
 
-// SeedContacts inserts example contacts (friends) with Chinese names and pinyin aliases.
-// Safe to call multiple times; individual insert errors are logged but not fatal.
+// SearchContactHitsContext is SearchContactHits with a context.
+func SearchContactHitsContext(ctx context.Context, db *sql.DB, clause string, opts HighlightOptions) ([]ContactHit, error) {
+	p, err := SearchContactPageContext(ctx, db, clause, opts, SearchOptions{})
+	return p.Hits, err
+}
+
+// SearchContactPage returns one page of SearchContactHits.
+func SearchContactPage(db *sql.DB, clause string, opts HighlightOptions, page SearchOptions) (Page[ContactHit], error) {
+	return SearchContactPageContext(context.Background(), db, clause, opts, page)
+}
+
+// SearchContactPageContext is SearchContactPage with a context.
+func SearchContactPageContext(ctx context.Context, db *sql.DB, clause string, opts HighlightOptions, page SearchOptions) (Page[ContactHit], error) {
+	p, err := contactCollection.SearchContext(ctx, db, clause, opts, page)
+	return mapPage(p, func(h Hit[Contact]) ContactHit {
+		return ContactHit{Contact: h.Value, Spans: h.Spans, Highlighted: h.Highlighted, Score: h.Score}
+	}), err
+}
+
+// SeedContacts upserts example contacts (friends) with Chinese names and pinyin aliases.
+// It runs in one transaction and is idempotent; individual upsert errors are logged to Logger but not fatal.
 func SeedContacts(db *sql.DB) error {
+	return SeedContactsContext(context.Background(), db)
+}
+
+// SeedContactsContext is SeedContacts with a context.
+func SeedContactsContext(ctx context.Context, db *sql.DB) error {
 	contacts := []Contact{
 		{Uid: 1001, Name: "张三", Alias: "zhangsan"},
 		{Uid: 1002, Name: "李四", Alias: "lisi"},
@@ -113,10 +194,10 @@ func SeedContacts(db *sql.DB) error {
 		{Uid: 1008, Name: "小红", Alias: "xiaohong"},
 	}
 
-	for _, c := range contacts {
-		if err := InsertContact(db, c); err != nil {
-			log.Printf("SeedContacts: failed to insert uid=%d name=%q: %v", c.Uid, c.Name, err)
-		}
+	res, err := UpsertContactsContext(ctx, db, contacts, BestEffort)
+	for _, f := range res.Failed {
+		c := contacts[f.Index]
+		logf("SeedContacts: failed to upsert uid=%d name=%q: %v", c.Uid, c.Name, f.Err)
 	}
-	return nil
+	return err
 }
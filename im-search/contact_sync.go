@@ -0,0 +1,85 @@
+package im_search
+
+import (
+	"context"
+	"database/sql"
+)
+
+// propagateContact copies the name and alias of c into the group_member rows of its uid,
+// which keep copies of them. Every write of a contact runs it in its transaction, and
+// syncMember every write of a member, so ReconcileGroupMembers only has copies that drifted
+// before to fix. Messages keep no copy: their DisplayName is read from the contact.
+func propagateContact(ctx context.Context, db dbtx, c Contact) error {
+	_, err := db.ExecContext(ctx, `UPDATE group_member SET name = ?, alias = ? WHERE uid = ? AND (name <> ? OR alias <> ?);`, c.Name, c.Alias, c.Uid, c.Name, c.Alias)
+	return err
+}
+
+// syncMember copies the name and alias of the contact with the uid of gm, if there is one,
+// into the group_member row of gm.
+func syncMember(ctx context.Context, db dbtx, gm GroupMember) error {
+	_, err := db.ExecContext(ctx, `UPDATE group_member AS m SET name = c.name, alias = c.alias FROM contact AS c
+		WHERE c.uid = m.uid AND m.gid = ? AND m.uid = ? AND (m.name <> c.name OR m.alias <> c.alias);`, gm.Gid, gm.Uid)
+	return err
+}
+
+// MemberDrift is a group_member row whose name or alias differs from its contact.
+type MemberDrift struct {
+	Gid, Uid                  int
+	Name, Alias               string // as in group_member
+	ContactName, ContactAlias string // as in contact
+}
+
+// FindMemberDrift returns the group_member rows whose name or alias differs from the
+// contact with the same uid, ordered by gid and uid.
+func FindMemberDrift(db *sql.DB) ([]MemberDrift, error) {
+	return FindMemberDriftContext(context.Background(), db)
+}
+
+// FindMemberDriftContext is FindMemberDrift with a context.
+func FindMemberDriftContext(ctx context.Context, db *sql.DB) ([]MemberDrift, error) {
+	drift, err := findMemberDrift(ctx, db)
+	return drift, opError("FindMemberDrift", err)
+}
+
+func findMemberDrift(ctx context.Context, db dbtx) ([]MemberDrift, error) {
+	rows, err := db.QueryContext(ctx, `SELECT m.gid, m.uid, m.name, m.alias, c.name, c.alias FROM group_member m JOIN contact c ON c.uid = m.uid
+		WHERE m.name <> c.name OR m.alias <> c.alias ORDER BY m.gid, m.uid;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var drift []MemberDrift
+	for rows.Next() {
+		var d MemberDrift
+		if err := rows.Scan(&d.Gid, &d.Uid, &d.Name, &d.Alias, &d.ContactName, &d.ContactAlias); err != nil {
+			return drift, err
+		}
+		drift = append(drift, d)
+	}
+	return drift, rows.Err()
+}
+
+// ReconcileGroupMembers copies the name and alias of every contact into the group_member
+// rows of its uid that differ, in one transaction, and returns the rows it fixed.
+func ReconcileGroupMembers(db *sql.DB) ([]MemberDrift, error) {
+	return ReconcileGroupMembersContext(context.Background(), db)
+}
+
+// ReconcileGroupMembersContext is ReconcileGroupMembers with a context.
+func ReconcileGroupMembersContext(ctx context.Context, db *sql.DB) ([]MemberDrift, error) {
+	var drift []MemberDrift
+	err := inTx(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+		var err error
+		if drift, err = findMemberDrift(ctx, tx); err != nil || len(drift) == 0 {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE group_member AS m SET name = c.name, alias = c.alias FROM contact AS c
+			WHERE c.uid = m.uid AND (m.name <> c.name OR m.alias <> c.alias);`)
+		return err
+	})
+	if err != nil {
+		return nil, opError("ReconcileGroupMembers", err)
+	}
+	return drift, nil
+}
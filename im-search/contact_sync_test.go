@@ -0,0 +1,37 @@
+package im_search
+
+import "testing"
+
+func TestMemberWritesCopyContactNames(t *testing.T) {
+	db := openTestDB(t)
+	if err := InsertContact(db, Contact{Uid: 1, Name: "张三", Alias: "老张"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := InsertGroupMember(db, GroupMember{Gid: 10, Uid: 1, Name: "旧名", AliasInGroup: "组长"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UpsertGroupMembers(db, []GroupMember{{Gid: 11, Uid: 1, Name: "旧名"}, {Gid: 11, Uid: 2, Name: "王五"}}, AllOrNothing); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateContact(db, Contact{Uid: 1, Name: "张三丰", Alias: "老张"}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []GroupMember{
+		{Gid: 10, Uid: 1, Name: "张三丰", Alias: "老张", AliasInGroup: "组长"},
+		{Gid: 11, Uid: 1, Name: "张三丰", Alias: "老张"},
+		{Gid: 11, Uid: 2, Name: "王五"},
+	}
+	for _, w := range want {
+		got, err := GetGroupMember(db, w.Gid, w.Uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != w {
+			t.Errorf("GetGroupMember(%d, %d) = %+v, want %+v", w.Gid, w.Uid, got, w)
+		}
+	}
+	if drift, err := FindMemberDrift(db); err != nil || len(drift) > 0 {
+		t.Errorf("FindMemberDrift = %v, %v, want none", drift, err)
+	}
+}
@@ -0,0 +1,79 @@
+package im_search
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	sql.Register("sqlite3_simple_test", &sqlite3.SQLiteDriver{
+		Extensions: []string{"../libsimple-osx-x64/libsimple"},
+	})
+}
+
+// openTestDB returns an in-memory database migrated to the latest schema. Where the simple
+// extension cannot be loaded, indexes use FTS5's own tokenizer and highlight instead.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3_simple_test", ":memory:")
+	if err == nil {
+		err = db.Ping()
+	}
+	if err != nil {
+		ftsTokenize, ftsHighlight = "unicode61", "highlight"
+		if db, err = sql.Open("sqlite3", ":memory:"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Every connection to :memory: is a database of its own.
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec(`CREATE VIRTUAL TABLE temp.fts5_probe USING fts5(x);`); err != nil {
+		t.Skipf("FTS5 is not available, run go test -tags fts5: %v", err)
+	}
+	if _, err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// seed runs every Seed function on db.
+func seed(t *testing.T, db *sql.DB) {
+	t.Helper()
+	for _, seed := range []func(*sql.DB) error{SeedChatGroups, SeedGroupMembers, SeedContacts, SeedChatMessages} {
+		if err := seed(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// rowCounts returns the number of rows of every table of db by name.
+func rowCounts(t *testing.T, db *sql.DB) map[string]int {
+	t.Helper()
+	rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type = 'table' ORDER BY name;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+
+	counts := make(map[string]int, len(tables))
+	for _, table := range tables {
+		var n int
+		if err := db.QueryRow(`SELECT count(*) FROM "` + table + `";`).Scan(&n); err != nil {
+			t.Fatalf("count %s: %v", table, err)
+		}
+		counts[table] = n
+	}
+	return counts
+}
@@ -0,0 +1,237 @@
+package im_search
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DeletePolicy selects what deleting a chat group or contact does to the rows belonging to it.
+type DeletePolicy int
+
+const (
+	// Cascade deletes the rows belonging to the group or contact along with it.
+	Cascade DeletePolicy = iota
+	// SoftDelete moves the group or contact and the rows belonging to it to the trash
+	// table, out of every search, until RestoreChatGroup or RestoreContact puts them back
+	// or PurgeDeleted removes them. It needs schema version 2, see Migrate.
+	SoftDelete
+	// Restrict fails with ErrReferenced while any row belongs to the group or contact.
+	Restrict
+)
+
+// DeleteOptions selects what DeleteChatGroupWith and DeleteContactWith do to the rows
+// belonging to the group or contact. The rows of a group are its members, its messages and
+// their mentions. Those of a contact are its group memberships, which copy its name and
+// alias, and the messages of the direct chat with it with their mentions.
+type DeleteOptions struct {
+	Policy DeletePolicy
+	// SentMessages makes the group messages a contact sent, and their mentions, rows of the
+	// contact too. They are kept by default as part of the history of their group, where
+	// their sender then shows no display name.
+	SentMessages bool
+}
+
+// dependent is a table holding rows of a group or contact.
+type dependent struct {
+	table   string
+	columns []string // columns of table, tableColumns[table] when nil
+	where   string   // condition selecting the rows of the subject, binding its id at every ?
+}
+
+func (d dependent) columnNames() []string {
+	if d.columns != nil {
+		return d.columns
+	}
+	return columnsOf(d.table)
+}
+
+// args returns the arguments of d.where for the subject id.
+func (d dependent) args(id int) []any {
+	args := make([]any, strings.Count(d.where, "?"))
+	for i := range args {
+		args[i] = id
+	}
+	return args
+}
+
+// subject is a chat group or contact. Its dependents are ordered so that rows come before
+// the rows they refer to, and the last one is the table of the subject itself.
+type subject struct {
+	typ        string // subject_type of its messages
+	key        string
+	dependents []dependent
+}
+
+var groupSubject = newSubject("group", "chat_group", "gid", "subject_type = 'group' AND subject_id = ?",
+	dependent{table: "group_member", where: "gid = ?"})
+
+// contactSubject returns the subject of contacts deleted with opts.
+func contactSubject(opts DeleteOptions) subject {
+	messages := "subject_type = 'contact' AND subject_id = ?"
+	if opts.SentMessages {
+		messages = "(" + messages + ") OR (subject_type = 'group' AND sender_uid = ?)"
+	}
+	return newSubject("contact", "contact", "uid", messages, dependent{table: "group_member", where: "uid = ?"})
+}
+
+// newSubject returns the subject whose messages are selected by messages.
+func newSubject(typ, table, key, messages string, rows ...dependent) subject {
+	s := subject{typ: typ, key: key}
+	s.dependents = append(s.dependents,
+		dependent{table: "chat_message_mention", columns: []string{"cid", "uid"}, where: "cid IN (SELECT cid FROM chat_message WHERE " + messages + ")"},
+		dependent{table: "chat_message", where: messages},
+	)
+	s.dependents = append(s.dependents, rows...)
+	s.dependents = append(s.dependents, dependent{table: table, where: key + " = ?"})
+	return s
+}
+
+// own returns the dependent that is the table of s itself.
+func (s subject) own() dependent {
+	return s.dependents[len(s.dependents)-1]
+}
+
+// deleteSubject deletes the subject id under policy. It fails with ErrNotFound when id
+// does not exist.
+func deleteSubject(ctx context.Context, tx *sql.Tx, s subject, id int, policy DeletePolicy) error {
+	own := s.own()
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM `+own.table+` WHERE `+own.where+`);`, own.args(id)...).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%s %s=%d %w", own.table, s.key, id, ErrNotFound)
+	}
+
+	switch policy {
+	case Restrict:
+		for i := len(s.dependents) - 2; i >= 0; i-- {
+			d := s.dependents[i]
+			var referenced bool
+			if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM `+d.table+` WHERE `+d.where+`);`, d.args(id)...).Scan(&referenced); err != nil {
+				return err
+			}
+			if referenced {
+				return fmt.Errorf("%s %s=%d %w by %s", own.table, s.key, id, ErrReferenced, d.table)
+			}
+		}
+	case SoftDelete:
+		// A subject deleted again after being recreated replaces its earlier trash.
+		if _, err := tx.ExecContext(ctx, `DELETE FROM trash WHERE subject_type = ? AND subject_id = ?;`, s.typ, id); err != nil {
+			return err
+		}
+		deletedAt := time.Now().UnixMilli()
+		for _, d := range s.dependents {
+			var pairs []string
+			for _, col := range d.columnNames() {
+				pairs = append(pairs, "'"+col+"', "+col)
+			}
+			trashSQL := `INSERT INTO trash(subject_type, subject_id, tbl, row, deleted_at) SELECT ?, ?, ?, json_object(` + strings.Join(pairs, ", ") + `), ? FROM ` + d.table + ` WHERE ` + d.where + `;`
+			if _, err := tx.ExecContext(ctx, trashSQL, append([]any{s.typ, id, d.table, deletedAt}, d.args(id)...)...); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, d := range s.dependents {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+d.table+` WHERE `+d.where+`;`, d.args(id)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreSubject moves the soft-deleted subject id back out of the trash. It fails with
+// ErrNotFound when the trash does not hold id, and with ErrDuplicate when a row with the
+// key of a restored one was written since.
+func restoreSubject(ctx context.Context, tx *sql.Tx, s subject, id int) error {
+	own := s.own()
+	for i := len(s.dependents) - 1; i >= 0; i-- {
+		d := s.dependents[i]
+		cols := d.columnNames()
+		values := make([]string, len(cols))
+		for j, col := range cols {
+			values[j] = "json_extract(row, '$." + col + "')"
+		}
+		restoreSQL := `INSERT INTO ` + d.table + `(` + strings.Join(cols, ", ") + `) SELECT ` + strings.Join(values, ", ") + ` FROM trash WHERE subject_type = ? AND subject_id = ? AND tbl = ? ORDER BY id;`
+		res, err := tx.ExecContext(ctx, restoreSQL, s.typ, id, d.table)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 && d.table == own.table {
+			return fmt.Errorf("%s %s=%d in trash %w", own.table, s.key, id, ErrNotFound)
+		}
+	}
+	_, err := tx.ExecContext(ctx, `DELETE FROM trash WHERE subject_type = ? AND subject_id = ?;`, s.typ, id)
+	return err
+}
+
+// CreateTrashTable creates the table SoftDelete moves deleted groups and contacts to, with
+// every row as a JSON object. Migrate creates it as part of schema version 2.
+func CreateTrashTable(db *sql.DB) error {
+	return CreateTrashTableContext(context.Background(), db)
+}
+
+// CreateTrashTableContext is CreateTrashTable with a context.
+func CreateTrashTableContext(ctx context.Context, db *sql.DB) error {
+	return opError("CreateTrashTable", createTrashTable(ctx, db))
+}
+
+func createTrashTable(ctx context.Context, db dbtx) error {
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS trash (id INTEGER PRIMARY KEY, subject_type TEXT NOT NULL, subject_id INTEGER NOT NULL, tbl TEXT NOT NULL, row TEXT NOT NULL, deleted_at INTEGER NOT NULL);`,
+		`CREATE INDEX IF NOT EXISTS idx_trash_subject ON trash(subject_type, subject_id);`,
+	}
+	for _, stmt := range stmts {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreChatGroup puts back a chat group soft-deleted by DeleteChatGroup, with its members
+// and messages.
+func RestoreChatGroup(db *sql.DB, gid int) error {
+	return RestoreChatGroupContext(context.Background(), db, gid)
+}
+
+// RestoreChatGroupContext is RestoreChatGroup with a context.
+func RestoreChatGroupContext(ctx context.Context, db *sql.DB, gid int) error {
+	return opError("RestoreChatGroup", inTx(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+		return restoreSubject(ctx, tx, groupSubject, gid)
+	}))
+}
+
+// RestoreContact puts back a contact soft-deleted by DeleteContact, with its group
+// memberships, messages and mentions.
+func RestoreContact(db *sql.DB, uid int) error {
+	return RestoreContactContext(context.Background(), db, uid)
+}
+
+// RestoreContactContext is RestoreContact with a context.
+func RestoreContactContext(ctx context.Context, db *sql.DB, uid int) error {
+	return opError("RestoreContact", inTx(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+		// The trash is restored by table, so any options select every row it may hold.
+		return restoreSubject(ctx, tx, contactSubject(DeleteOptions{}), uid)
+	}))
+}
+
+// PurgeDeleted permanently removes the groups and contacts soft-deleted before the given
+// time and returns the number of rows removed from the trash.
+func PurgeDeleted(db *sql.DB, before time.Time) (int64, error) {
+	return PurgeDeletedContext(context.Background(), db, before)
+}
+
+// PurgeDeletedContext is PurgeDeleted with a context.
+func PurgeDeletedContext(ctx context.Context, db *sql.DB, before time.Time) (int64, error) {
+	res, err := db.ExecContext(ctx, `DELETE FROM trash WHERE deleted_at < ?;`, before.UnixMilli())
+	if err != nil {
+		return 0, opError("PurgeDeleted", err)
+	}
+	n, _ := res.RowsAffected()
+	return n, nil
+}
@@ -0,0 +1,119 @@
+package im_search
+
+import (
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// seedContactRows writes contacts 1 and 2, both members of group 10, a direct message with
+// contact 1 and a group message from each of them mentioning the other.
+func seedContactRows(t *testing.T, db *sql.DB) {
+	t.Helper()
+	steps := []error{
+		InsertContact(db, Contact{Uid: 1, Name: "张三"}),
+		InsertContact(db, Contact{Uid: 2, Name: "李四"}),
+		InsertChatGroup(db, ChatGroup{Gid: 10, Name: "项目组"}),
+		InsertGroupMember(db, GroupMember{Gid: 10, Uid: 1, Name: "张三"}),
+		InsertGroupMember(db, GroupMember{Gid: 10, Uid: 2, Name: "李四"}),
+		InsertChatMessage(db, ChatMessage{Cid: 100, SubjectType: "contact", SubjectId: 1, SenderUid: 1, Message: "在吗"}),
+		InsertChatMessage(db, ChatMessage{Cid: 101, SubjectType: "group", SubjectId: 10, SenderUid: 1, Message: "@李四 请看"}),
+		InsertChatMessage(db, ChatMessage{Cid: 102, SubjectType: "group", SubjectId: 10, SenderUid: 2, Message: "@张三 收到"}),
+	}
+	for _, err := range steps {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec(`INSERT OR IGNORE INTO chat_message_mention(cid, uid) VALUES (101, 2), (102, 1);`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// contactRows returns the keys of the rows seedContactRows writes that are left in db.
+func contactRows(t *testing.T, db *sql.DB) map[string][]int {
+	t.Helper()
+	queries := map[string]string{
+		"contact":              `SELECT uid FROM contact ORDER BY uid;`,
+		"group_member":         `SELECT uid FROM group_member ORDER BY uid;`,
+		"chat_message":         `SELECT cid FROM chat_message ORDER BY cid;`,
+		"chat_message_mention": `SELECT cid FROM chat_message_mention ORDER BY cid;`,
+	}
+	left := make(map[string][]int)
+	for table, query := range queries {
+		rows, err := db.Query(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var k int
+			if err := rows.Scan(&k); err != nil {
+				t.Fatal(err)
+			}
+			left[table] = append(left[table], k)
+		}
+		rows.Close()
+	}
+	return left
+}
+
+func TestDeleteContactPolicies(t *testing.T) {
+	// Group message 102 of uid 2, and its mention of uid 1, stay by default.
+	cascaded := map[string][]int{"contact": {2}, "group_member": {2}, "chat_message": {101, 102}, "chat_message_mention": {101, 102}}
+	tests := []struct {
+		name string
+		opts DeleteOptions
+		want map[string][]int
+	}{
+		{"cascade", DeleteOptions{Policy: Cascade}, cascaded},
+		{"sent messages", DeleteOptions{Policy: Cascade, SentMessages: true}, map[string][]int{"contact": {2}, "group_member": {2}, "chat_message": {102}, "chat_message_mention": {102}}},
+		{"soft delete", DeleteOptions{Policy: SoftDelete}, cascaded},
+		{"soft delete sent messages", DeleteOptions{Policy: SoftDelete, SentMessages: true}, map[string][]int{"contact": {2}, "group_member": {2}, "chat_message": {102}, "chat_message_mention": {102}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t)
+			seedContactRows(t, db)
+			before := contactRows(t, db)
+			if err := DeleteContactWith(db, 1, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			if got := contactRows(t, db); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rows after DeleteContactWith = %v, want %v", got, tt.want)
+			}
+			if tt.opts.Policy != SoftDelete {
+				return
+			}
+			if err := RestoreContact(db, 1); err != nil {
+				t.Fatal(err)
+			}
+			if got := contactRows(t, db); !reflect.DeepEqual(got, before) {
+				t.Errorf("rows after RestoreContact = %v, want %v", got, before)
+			}
+		})
+	}
+
+	t.Run("default", func(t *testing.T) {
+		db := openTestDB(t)
+		seedContactRows(t, db)
+		if err := DeleteContact(db, 1); err != nil {
+			t.Fatal(err)
+		}
+		if got := contactRows(t, db); !reflect.DeepEqual(got, cascaded) {
+			t.Errorf("rows after DeleteContact = %v, want %v", got, cascaded)
+		}
+	})
+
+	t.Run("restrict", func(t *testing.T) {
+		db := openTestDB(t)
+		seedContactRows(t, db)
+		before := contactRows(t, db)
+		if err := DeleteContactWith(db, 1, DeleteOptions{Policy: Restrict}); !errors.Is(err, ErrReferenced) {
+			t.Errorf("DeleteContactWith error = %v, want ErrReferenced", err)
+		}
+		if got := contactRows(t, db); !reflect.DeepEqual(got, before) {
+			t.Errorf("rows after failed DeleteContactWith = %v, want %v", got, before)
+		}
+	})
+}
@@ -0,0 +1,300 @@
+package im_search
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Document is a row of a DocumentCollection keyed by column name. Columns missing from a
+// Document are inserted with their Default, or as 0, 0.0 or "" depending on their type
+// when they have none, and left as they are by Update.
+type Document map[string]any
+
+// DocumentCollection is a Collection declared at run time, typically by a collections config
+// file, whose rows are Documents. See LoadCollections.
+type DocumentCollection struct {
+	c *Collection[record]
+}
+
+// record holds the values of a Document in column order.
+type record struct {
+	values []any
+}
+
+// NewDocumentCollection validates cfg and registers its table for searching. Unlike
+// NewCollection it returns an error for a table that is already registered.
+func NewDocumentCollection(cfg CollectionConfig) (*DocumentCollection, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	n := len(cfg.Columns)
+	c, err := newCollection(Collection[record]{
+		Name:       goName(cfg.Name),
+		Table:      cfg.Name,
+		Columns:    cfg.Columns,
+		Key:        cfg.Key,
+		Indexes:    cfg.Indexes,
+		TimeColumn: cfg.TimeColumn,
+		Tokenize:   cfg.Tokenize,
+		Fields: func(r *record) []any {
+			if r.values == nil {
+				r.values = make([]any, n)
+			}
+			fields := make([]any, n)
+			for i := range r.values {
+				fields[i] = &r.values[i]
+			}
+			return fields
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &DocumentCollection{c: c}, nil
+}
+
+// Table returns the name of the table of d.
+func (d *DocumentCollection) Table() string {
+	return d.c.Table
+}
+
+// Create creates the tables of d if they don't exist.
+func (d *DocumentCollection) Create(db *sql.DB) error {
+	return d.CreateContext(context.Background(), db)
+}
+
+// CreateContext is Create with a context.
+func (d *DocumentCollection) CreateContext(ctx context.Context, db *sql.DB) error {
+	return d.c.CreateContext(ctx, db)
+}
+
+// Insert inserts doc. It fails if the key of doc already exists; use Upsert to replace it.
+func (d *DocumentCollection) Insert(db *sql.DB, doc Document) error {
+	return d.InsertContext(context.Background(), db, doc)
+}
+
+// InsertContext is Insert with a context.
+func (d *DocumentCollection) InsertContext(ctx context.Context, db *sql.DB, doc Document) error {
+	r, err := d.record(doc)
+	if err != nil {
+		return opError("Insert"+d.c.Name, err)
+	}
+	return d.c.InsertContext(ctx, db, r)
+}
+
+// Upsert inserts doc, or updates the row with the same key.
+func (d *DocumentCollection) Upsert(db *sql.DB, doc Document) error {
+	return d.UpsertContext(context.Background(), db, doc)
+}
+
+// UpsertContext is Upsert with a context.
+func (d *DocumentCollection) UpsertContext(ctx context.Context, db *sql.DB, doc Document) error {
+	r, err := d.record(doc)
+	if err != nil {
+		return opError("Upsert"+d.c.Name, err)
+	}
+	return d.c.UpsertContext(ctx, db, r)
+}
+
+// InsertAll inserts docs like Insert in one transaction. Documents with unknown columns are
+// rejected before anything is written, whatever mode is.
+func (d *DocumentCollection) InsertAll(db *sql.DB, docs []Document, mode BatchMode) (BatchResult, error) {
+	return d.InsertAllContext(context.Background(), db, docs, mode)
+}
+
+// InsertAllContext is InsertAll with a context.
+func (d *DocumentCollection) InsertAllContext(ctx context.Context, db *sql.DB, docs []Document, mode BatchMode) (BatchResult, error) {
+	records, err := d.records(docs)
+	if err != nil {
+		return BatchResult{}, opError("Insert"+d.c.Name+"s", err)
+	}
+	return d.c.InsertAllContext(ctx, db, records, mode)
+}
+
+// UpsertAll upserts docs like Upsert in one transaction, rejecting them like InsertAll.
+func (d *DocumentCollection) UpsertAll(db *sql.DB, docs []Document, mode BatchMode) (BatchResult, error) {
+	return d.UpsertAllContext(context.Background(), db, docs, mode)
+}
+
+// UpsertAllContext is UpsertAll with a context.
+func (d *DocumentCollection) UpsertAllContext(ctx context.Context, db *sql.DB, docs []Document, mode BatchMode) (BatchResult, error) {
+	records, err := d.records(docs)
+	if err != nil {
+		return BatchResult{}, opError("Upsert"+d.c.Name+"s", err)
+	}
+	return d.c.UpsertAllContext(ctx, db, records, mode)
+}
+
+// Update sets the columns present in doc of the row with the key of doc. doc must hold every
+// key column.
+func (d *DocumentCollection) Update(db *sql.DB, doc Document) error {
+	return d.UpdateContext(context.Background(), db, doc)
+}
+
+// UpdateContext is Update with a context.
+func (d *DocumentCollection) UpdateContext(ctx context.Context, db *sql.DB, doc Document) error {
+	r, err := d.record(doc)
+	if err == nil {
+		for _, k := range d.c.Key {
+			if _, ok := doc[k]; !ok {
+				err = fmt.Errorf("document has no key column %s", k)
+				break
+			}
+		}
+	}
+	if err != nil {
+		return opError("Update"+d.c.Name, err)
+	}
+	var columns []string
+	for _, col := range d.c.Columns {
+		if _, ok := doc[col.Name]; ok && !d.c.isKey(col.Name) {
+			columns = append(columns, col.Name)
+		}
+	}
+	return d.c.update(ctx, db, r, columns)
+}
+
+// Delete removes the row with key, given in the order of the collection's key columns.
+func (d *DocumentCollection) Delete(db *sql.DB, key ...any) error {
+	return d.DeleteContext(context.Background(), db, key...)
+}
+
+// DeleteContext is Delete with a context.
+func (d *DocumentCollection) DeleteContext(ctx context.Context, db *sql.DB, key ...any) error {
+	return d.c.DeleteContext(ctx, db, key...)
+}
+
+// Get retrieves the row with key. It fails with ErrNotFound if there is no such row.
+func (d *DocumentCollection) Get(db *sql.DB, key ...any) (Document, error) {
+	return d.GetContext(context.Background(), db, key...)
+}
+
+// GetContext is Get with a context.
+func (d *DocumentCollection) GetContext(ctx context.Context, db *sql.DB, key ...any) (Document, error) {
+	r, err := d.c.GetContext(ctx, db, key...)
+	if err != nil {
+		return nil, err
+	}
+	return d.document(r), nil
+}
+
+// Search runs query through the qparser pipeline used by SearchAll and returns one page of
+// matching documents. Pinyin columns match the pinyin readings and initials qparser derives
+// from latin terms, and have their hanzi highlighted by pinyin; other Indexed columns must
+// contain every term of query.
+func (d *DocumentCollection) Search(db *sql.DB, query string, opts HighlightOptions, page SearchOptions) (Page[Hit[Document]], error) {
+	return d.SearchContext(context.Background(), db, query, opts, page)
+}
+
+// SearchContext is Search with a context.
+func (d *DocumentCollection) SearchContext(ctx context.Context, db *sql.DB, query string, opts HighlightOptions, page SearchOptions) (Page[Hit[Document]], error) {
+	clause := d.clause(query)
+	if clause == "" {
+		return Page[Hit[Document]]{Total: -1}, nil
+	}
+	if opts.PinyinQuery == "" {
+		opts.PinyinQuery = query
+	}
+	p, err := d.c.SearchContext(ctx, db, clause, opts, page)
+	return mapPage(p, func(h Hit[record]) Hit[Document] {
+		return Hit[Document]{Value: d.document(h.Value), Spans: h.Spans, Highlighted: h.Highlighted, Score: h.Score}
+	}), err
+}
+
+// clause returns the FTS5 clause of query, restricting the pinyin alternatives of qparser
+// to Pinyin columns.
+func (d *DocumentCollection) clause(query string) string {
+	var pinyin, plain []string
+	for _, col := range d.c.Columns {
+		switch {
+		case col.Indexed && col.Pinyin:
+			pinyin = append(pinyin, col.Name)
+		case col.Indexed:
+			plain = append(plain, col.Name)
+		}
+	}
+	var parts []string
+	if c := parseClause(query); c != "" && len(pinyin) > 0 {
+		parts = append(parts, "{"+strings.Join(pinyin, " ")+"} : ("+c+")")
+	}
+	if c := messageClause(query); c != "" && len(plain) > 0 {
+		parts = append(parts, "{"+strings.Join(plain, " ")+"} : ("+c+")")
+	}
+	return strings.Join(parts, " OR ")
+}
+
+// record converts doc to column order, failing on columns d does not have.
+func (d *DocumentCollection) record(doc Document) (record, error) {
+	r := record{values: make([]any, len(d.c.Columns))}
+	index := make(map[string]int, len(d.c.Columns))
+	for i, col := range d.c.Columns {
+		index[col.Name] = i
+		r.values[i] = defaultValue(col)
+	}
+	var unknown []string
+	for name, v := range doc {
+		i, ok := index[name]
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		r.values[i] = v
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return r, fmt.Errorf("collection %s has no column %s", d.c.Table, strings.Join(unknown, ", "))
+	}
+	return r, nil
+}
+
+// defaultValue returns the value of col in a Document lacking it: its Default, which
+// validate allows to be a number or a quoted string only, or the zero value of its type.
+func defaultValue(col Column) any {
+	switch {
+	case strings.HasPrefix(col.Default, "'"):
+		return strings.Trim(col.Default, "'")
+	case col.Default != "":
+		if n, err := strconv.ParseInt(col.Default, 10, 64); err == nil {
+			return n
+		}
+		if f, err := strconv.ParseFloat(col.Default, 64); err == nil {
+			return f
+		}
+	}
+	switch col.Type {
+	case "INTEGER":
+		return 0
+	case "REAL":
+		return 0.0
+	}
+	return ""
+}
+
+func (d *DocumentCollection) records(docs []Document) ([]record, error) {
+	records := make([]record, len(docs))
+	for i, doc := range docs {
+		r, err := d.record(doc)
+		if err != nil {
+			return nil, ItemError{Index: i, Err: err}
+		}
+		records[i] = r
+	}
+	return records, nil
+}
+
+// document converts r back to a Document, with TEXT values as strings.
+func (d *DocumentCollection) document(r record) Document {
+	doc := make(Document, len(d.c.Columns))
+	for i, col := range d.c.Columns {
+		v := r.values[i]
+		if b, ok := v.([]byte); ok {
+			v = string(b)
+		}
+		doc[col.Name] = v
+	}
+	return doc
+}
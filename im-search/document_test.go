@@ -0,0 +1,70 @@
+package im_search
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+var (
+	ticketsOnce sync.Once
+	tickets     *DocumentCollection
+)
+
+// ticketCollection returns a DocumentCollection registered once per test binary, as the
+// registry has no way to drop a table.
+func ticketCollection(t *testing.T) *DocumentCollection {
+	t.Helper()
+	var err error
+	ticketsOnce.Do(func() {
+		tickets, err = NewDocumentCollection(CollectionConfig{
+			Name: "ticket",
+			Key:  []string{"tid"},
+			Columns: []Column{
+				{Name: "tid", Type: "INTEGER"},
+				{Name: "title", Type: "TEXT", Indexed: true},
+				{Name: "body", Type: "TEXT", Indexed: true},
+				{Name: "status", Type: "TEXT", Default: "'open'"},
+				{Name: "priority", Type: "INTEGER", Default: "3"},
+			},
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tickets
+}
+
+func TestDocumentDefaultsAndPartialUpdate(t *testing.T) {
+	db := openTestDB(t)
+	c := ticketCollection(t)
+	if err := c.Create(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Insert(db, Document{"tid": 1, "title": "crash", "body": "on start"}); err != nil {
+		t.Fatal(err)
+	}
+	get := func() Document {
+		t.Helper()
+		doc, err := c.Get(db, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return doc
+	}
+	want := Document{"tid": int64(1), "title": "crash", "body": "on start", "status": "open", "priority": int64(3)}
+	if got := get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("inserted %v, want %v", got, want)
+	}
+
+	if err := c.Update(db, Document{"tid": 1, "title": "crash on start"}); err != nil {
+		t.Fatal(err)
+	}
+	want["title"] = "crash on start"
+	if got := get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("after partial update %v, want %v", got, want)
+	}
+	if err := c.Update(db, Document{"title": "no key"}); err == nil {
+		t.Error("Update without the key column succeeded")
+	}
+}
@@ -0,0 +1,117 @@
+package im_search
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+var (
+	// ErrNotFound is returned by Get, Update and Delete functions when no row has the key.
+	ErrNotFound = errors.New("not found")
+	// ErrDuplicate is returned by Insert functions when a row with the key already exists.
+	ErrDuplicate = errors.New("duplicate key")
+	// ErrInvalidQuery is returned by searches given a query, page token or sort order they
+	// cannot run, such as an FTS5 syntax error.
+	ErrInvalidQuery = errors.New("invalid query")
+	// ErrReferenced is returned by deletes under the Restrict policy when rows still belong
+	// to the deleted group or contact.
+	ErrReferenced = errors.New("still referenced")
+)
+
+// Error is the error of a failed operation, such as InsertContact or SearchContacts. Use
+// errors.Is with ErrNotFound, ErrDuplicate, ErrInvalidQuery or ErrReferenced to tell the
+// common cases apart.
+type Error struct {
+	Op string
+	// Code and ExtendedCode are the SQLite result codes when Err comes from SQLite, 0 otherwise.
+	Code         sqlite3.ErrNo
+	ExtendedCode sqlite3.ErrNoExtended
+	Err          error
+	kind         error // ErrNotFound, ErrDuplicate, ErrInvalidQuery or ErrReferenced when Err amounts to one
+}
+
+func (e *Error) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether e amounts to target, one of ErrNotFound, ErrDuplicate, ErrInvalidQuery
+// and ErrReferenced.
+func (e *Error) Is(target error) bool {
+	return e.kind != nil && target == e.kind
+}
+
+// Logger receives what the package reports without failing, such as the items a seed could
+// not write. It is nil by default, which discards them; errors are always returned instead.
+var Logger *log.Logger
+
+func logf(format string, args ...any) {
+	if Logger != nil {
+		Logger.Printf(format, args...)
+	}
+}
+
+// opError wraps err, if not nil, in an Error of op carrying its SQLite codes. An err that
+// already is an Error, from an operation op is built on, is returned as is.
+func opError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	e = &Error{Op: op, Err: err}
+	var sqliteErr sqlite3.Error
+	switch {
+	case errors.As(err, &sqliteErr):
+		e.Code, e.ExtendedCode = sqliteErr.Code, sqliteErr.ExtendedCode
+		if e.ExtendedCode == sqlite3.ErrConstraintUnique || e.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+			e.kind = ErrDuplicate
+		}
+	case errors.Is(err, ErrNotFound):
+		e.kind = ErrNotFound
+	case errors.Is(err, ErrReferenced):
+		e.kind = ErrReferenced
+	case errors.Is(err, ErrInvalidPageToken), errors.Is(err, ErrUnsupportedOrder):
+		e.kind = ErrInvalidQuery
+	}
+	return e
+}
+
+// queryError is opError for searches, marking SQLite rejecting their FTS5 clause as
+// ErrInvalidQuery.
+func queryError(op string, err error) error {
+	err = opError(op, err)
+	var e *Error
+	if errors.As(err, &e) && e.Code == sqlite3.ErrError && isClauseError(e.Err) {
+		e.kind = ErrInvalidQuery
+	}
+	return err
+}
+
+// invalidQuery wraps err, a query that could not be parsed, in an ErrInvalidQuery Error of op.
+func invalidQuery(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Op: op, Err: err, kind: ErrInvalidQuery}
+}
+
+// isClauseError reports whether err is SQLite rejecting an FTS5 query: a syntax error or a
+// column filter naming a column the index does not have.
+func isClauseError(err error) bool {
+	msg := err.Error()
+	for _, prefix := range []string{"fts5:", "no such column", "unterminated string", "unknown special query"} {
+		if strings.HasPrefix(msg, prefix) {
+			return true
+		}
+	}
+	return false
+}
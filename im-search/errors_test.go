@@ -0,0 +1,55 @@
+package im_search
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestErrorKinds(t *testing.T) {
+	db := openTestDB(t)
+	seedContactRows(t, db)
+	tests := []struct {
+		name string
+		err  func() error
+		want error
+	}{
+		{"GetContact", func() error { _, err := GetContact(db, 42); return err }, ErrNotFound},
+		{"GetChatGroup", func() error { _, err := GetChatGroup(db, 42); return err }, ErrNotFound},
+		{"GetGroupMember", func() error { _, err := GetGroupMember(db, 10, 42); return err }, ErrNotFound},
+		{"GetChatMessage", func() error { _, err := GetChatMessage(db, 42); return err }, ErrNotFound},
+		{"UpdateContact", func() error { return UpdateContact(db, Contact{Uid: 42, Name: "x"}) }, ErrNotFound},
+		{"UpdateChatMessage", func() error { return UpdateChatMessage(db, ChatMessage{Cid: 42, SubjectType: "contact", SubjectId: 1}) }, ErrNotFound},
+		{"DeleteChatMessage", func() error { return DeleteChatMessage(db, 42) }, ErrNotFound},
+		{"DeleteGroupMember", func() error { return DeleteGroupMember(db, 10, 42) }, ErrNotFound},
+		{"DeleteContact", func() error { return DeleteContact(db, 42) }, ErrNotFound},
+		{"DeleteChatGroup", func() error { return DeleteChatGroup(db, 42) }, ErrNotFound},
+		{"InsertContact", func() error { return InsertContact(db, Contact{Uid: 1, Name: "x"}) }, ErrDuplicate},
+		{"InsertChatGroup", func() error { return InsertChatGroup(db, ChatGroup{Gid: 10, Name: "x"}) }, ErrDuplicate},
+		{"InsertGroupMember", func() error { return InsertGroupMember(db, GroupMember{Gid: 10, Uid: 1, Name: "x"}) }, ErrDuplicate},
+		{"InsertChatMessage", func() error {
+			return InsertChatMessage(db, ChatMessage{Cid: 100, SubjectType: "contact", SubjectId: 1})
+		}, ErrDuplicate},
+		{"DeleteContactWith Restrict", func() error { return DeleteContactWith(db, 1, DeleteOptions{Policy: Restrict}) }, ErrReferenced},
+		{"SearchContacts syntax", func() error { _, err := SearchContacts(db, `"unterminated`); return err }, ErrInvalidQuery},
+		{"SearchChatGroupHits column", func() error { _, err := SearchChatGroupHits(db, "nosuch:x", HighlightOptions{}); return err }, ErrInvalidQuery},
+		{"SearchChatMessagePage token", func() error {
+			_, err := SearchChatMessagePage(db, "x", HighlightOptions{}, SearchOptions{Limit: 1, PageToken: "!"})
+			return err
+		}, ErrInvalidQuery},
+		{"SearchChatMessagesQuery date", func() error {
+			_, err := SearchChatMessagesQuery(db, "after:tomorrow x", HighlightOptions{}, SearchOptions{})
+			return err
+		}, ErrInvalidQuery},
+		{"SearchAll date", func() error { _, err := SearchAll(db, "before:2026-99-01", SearchAllOptions{}); return err }, ErrInvalidQuery},
+	}
+	for _, tt := range tests {
+		err := tt.err()
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s error = %v, want %v", tt.name, err, tt.want)
+		}
+		var e *Error
+		if !errors.As(err, &e) || e.Op == "" {
+			t.Errorf("%s error = %v, want an *Error with its Op", tt.name, err)
+		}
+	}
+}
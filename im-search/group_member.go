@@ -1,10 +1,13 @@
 package im_search
 
 import (
+	"context"
 	"database/sql"
-	"log"
 )
 
+// GroupMember is a user in a chat group. Name and Alias are copies of those of the contact
+// with the same uid, which every write of either keeps in sync; they are only stored as
+// given for users without a contact.
 type GroupMember struct {
 	Gid          int
 	Uid          int
@@ -13,97 +16,169 @@ type GroupMember struct {
 	AliasInGroup string
 }
 
-// CreateGroupMemberTable creates the FTS5 virtual table if it doesn't exist.
+var groupMemberCollection = NewCollection(Collection[GroupMember]{
+	Name:  "GroupMember",
+	Table: "group_member",
+	Columns: []Column{
+		{Name: "gid", Type: "INTEGER"},
+		{Name: "uid", Type: "INTEGER"},
+		{Name: "name", Type: "TEXT", Default: "''", Indexed: true, Pinyin: true, Weight: 10},
+		{Name: "alias", Type: "TEXT", Default: "''", Indexed: true, Weight: 5},
+		{Name: "alias_in_group", Type: "TEXT", Default: "''", Indexed: true, Weight: 3},
+	},
+	Key:     []string{"gid", "uid"},
+	Indexes: []Index{{Name: "idx_group_member_uid", Columns: []string{"uid"}}},
+	Fields: func(gm *GroupMember) []any {
+		return []any{&gm.Gid, &gm.Uid, &gm.Name, &gm.Alias, &gm.AliasInGroup}
+	},
+	AfterWrite: func(ctx context.Context, tx *sql.Tx, gm GroupMember) error {
+		return syncMember(ctx, tx, gm)
+	},
+})
+
+// CreateGroupMemberTable creates the group_member table unique by gid and uid and its FTS5
+// index group_member_fts over name, alias and alias_in_group if they don't exist, migrating
+// a group_member table of the older standalone FTS5 layout. Members are also indexed by
+// uid, for looking up the groups of a user. Migrate runs it as part of schema version 1.
 func CreateGroupMemberTable(db *sql.DB) error {
-	createSQL := `CREATE VIRTUAL TABLE IF NOT EXISTS group_member USING fts5(gid, uid, name, alias, alias_in_group, tokenize = 'simple 1');`
-	_, err := db.Exec(createSQL)
-	if err != nil {
-		log.Printf("CreateGroupMemberTable error: %v", err)
-	}
-	return err
+	return CreateGroupMemberTableContext(context.Background(), db)
 }
 
-// InsertGroupMember inserts a new group member record.
+// CreateGroupMemberTableContext is CreateGroupMemberTable with a context.
+func CreateGroupMemberTableContext(ctx context.Context, db *sql.DB) error {
+	return groupMemberCollection.CreateContext(ctx, db)
+}
+
+// InsertGroupMember inserts a new group member record. It fails if gid+uid already
+// exists; use UpsertGroupMember to replace it.
 func InsertGroupMember(db *sql.DB, gm GroupMember) error {
-	insertSQL := `INSERT INTO group_member(gid, uid, name, alias, alias_in_group) VALUES (?, ?, ?, ?, ?);`
-	_, err := db.Exec(insertSQL, gm.Gid, gm.Uid, gm.Name, gm.Alias, gm.AliasInGroup)
-	if err != nil {
-		log.Printf("InsertGroupMember error: %v", err)
-	}
-	return err
+	return InsertGroupMemberContext(context.Background(), db, gm)
+}
+
+// InsertGroupMemberContext is InsertGroupMember with a context.
+func InsertGroupMemberContext(ctx context.Context, db *sql.DB, gm GroupMember) error {
+	return groupMemberCollection.InsertContext(ctx, db, gm)
+}
+
+// UpsertGroupMember inserts gm, or updates the group member with the same gid and uid.
+func UpsertGroupMember(db *sql.DB, gm GroupMember) error {
+	return UpsertGroupMemberContext(context.Background(), db, gm)
+}
+
+// UpsertGroupMemberContext is UpsertGroupMember with a context.
+func UpsertGroupMemberContext(ctx context.Context, db *sql.DB, gm GroupMember) error {
+	return groupMemberCollection.UpsertContext(ctx, db, gm)
+}
+
+// InsertGroupMembers inserts members like InsertGroupMember in one transaction.
+func InsertGroupMembers(db *sql.DB, members []GroupMember, mode BatchMode) (BatchResult, error) {
+	return InsertGroupMembersContext(context.Background(), db, members, mode)
+}
+
+// InsertGroupMembersContext is InsertGroupMembers with a context.
+func InsertGroupMembersContext(ctx context.Context, db *sql.DB, members []GroupMember, mode BatchMode) (BatchResult, error) {
+	return groupMemberCollection.InsertAllContext(ctx, db, members, mode)
+}
+
+// UpsertGroupMembers upserts members like UpsertGroupMember in one transaction.
+func UpsertGroupMembers(db *sql.DB, members []GroupMember, mode BatchMode) (BatchResult, error) {
+	return UpsertGroupMembersContext(context.Background(), db, members, mode)
+}
+
+// UpsertGroupMembersContext is UpsertGroupMembers with a context.
+func UpsertGroupMembersContext(ctx context.Context, db *sql.DB, members []GroupMember, mode BatchMode) (BatchResult, error) {
+	return groupMemberCollection.UpsertAllContext(ctx, db, members, mode)
 }
 
 // UpdateGroupMember updates name, alias and alias_in_group for an existing gid+uid.
 func UpdateGroupMember(db *sql.DB, gm GroupMember) error {
-	updateSQL := `UPDATE group_member SET name = ?, alias = ?, alias_in_group = ? WHERE gid = ? AND uid = ?;`
-	res, err := db.Exec(updateSQL, gm.Name, gm.Alias, gm.AliasInGroup, gm.Gid, gm.Uid)
-	if err != nil {
-		log.Printf("UpdateGroupMember error: %v", err)
-		return err
-	}
-	affected, _ := res.RowsAffected()
-	if affected == 0 {
-		log.Printf("UpdateGroupMember: no rows updated for gid=%d uid=%d", gm.Gid, gm.Uid)
-	}
-	return nil
+	return UpdateGroupMemberContext(context.Background(), db, gm)
+}
+
+// UpdateGroupMemberContext is UpdateGroupMember with a context.
+func UpdateGroupMemberContext(ctx context.Context, db *sql.DB, gm GroupMember) error {
+	return groupMemberCollection.UpdateContext(ctx, db, gm)
 }
 
 // DeleteGroupMember removes a group member by gid and uid.
 func DeleteGroupMember(db *sql.DB, gid, uid int) error {
-	deleteSQL := `DELETE FROM group_member WHERE gid = ? AND uid = ?;`
-	_, err := db.Exec(deleteSQL, gid, uid)
-	if err != nil {
-		log.Printf("DeleteGroupMember error: %v", err)
-	}
-	return err
+	return DeleteGroupMemberContext(context.Background(), db, gid, uid)
+}
+
+// DeleteGroupMemberContext is DeleteGroupMember with a context.
+func DeleteGroupMemberContext(ctx context.Context, db *sql.DB, gid, uid int) error {
+	return groupMemberCollection.DeleteContext(ctx, db, gid, uid)
 }
 
 // GetGroupMember retrieves a single group member by gid and uid.
 func GetGroupMember(db *sql.DB, gid, uid int) (GroupMember, error) {
-	var gm GroupMember
-	query := `SELECT gid, uid, name, alias, alias_in_group FROM group_member WHERE gid = ? AND uid = ? LIMIT 1;`
-	row := db.QueryRow(query, gid, uid)
-	err := row.Scan(&gm.Gid, &gm.Uid, &gm.Name, &gm.Alias, &gm.AliasInGroup)
-	if err == sql.ErrNoRows {
-		return gm, nil
-	}
-	if err != nil {
-		log.Printf("GetGroupMember error: %v", err)
-	}
-	return gm, err
+	return GetGroupMemberContext(context.Background(), db, gid, uid)
+}
+
+// GetGroupMemberContext is GetGroupMember with a context.
+func GetGroupMemberContext(ctx context.Context, db *sql.DB, gid, uid int) (GroupMember, error) {
+	return groupMemberCollection.GetContext(ctx, db, gid, uid)
+}
+
+// GroupMemberHit is a matched group member with raw field values and the spans that matched.
+type GroupMemberHit struct {
+	GroupMember
+	Spans       map[string][]Span // matched rune spans keyed by column: name, alias, alias_in_group
+	Highlighted map[string]string // name, alias and alias_in_group rendered with the call's HighlightOptions
+	Score       float64           // bm25 relevance with column weights; higher is better
 }
 
 // SearchGroupMembers uses FTS5 MATCH to find matching group members.
 // Provide a raw FTS5 query like: "name:alice OR alias:bob" or a simple term "alice".
+// Text fields come back with matches wrapped in '[' and ']'; use SearchGroupMemberHits for spans.
 func SearchGroupMembers(db *sql.DB, clause string) ([]GroupMember, error) {
-	sqlStmt := "SELECT gid, uid, simple_highlight(group_member, 2, '[', ']') , simple_highlight(group_member, 3, '[', ']'), simple_highlight(group_member, 4, '[', ']') FROM group_member WHERE (name MATCH ('" + clause + "')) OR (alias MATCH ('" + clause + "')) OR (alias_in_group MATCH ('" + clause + "'));"
-	//log.Println(sqlStmt)
-	rows, err := db.Query(sqlStmt)
-	if err != nil {
-		log.Printf("SearchGroupMembers query error: %v", err)
-		return nil, err
-	}
-	defer rows.Close()
+	return SearchGroupMembersContext(context.Background(), db, clause)
+}
 
+// SearchGroupMembersContext is SearchGroupMembers with a context.
+func SearchGroupMembersContext(ctx context.Context, db *sql.DB, clause string) ([]GroupMember, error) {
+	hits, err := SearchGroupMemberHitsContext(ctx, db, clause, DefaultHighlightOptions)
 	var results []GroupMember
-	for rows.Next() {
-		var gm GroupMember
-		if err := rows.Scan(&gm.Gid, &gm.Uid, &gm.Name, &gm.Alias, &gm.AliasInGroup); err != nil {
-			log.Printf("SearchGroupMembers scan error: %v", err)
-			continue
-		}
+	for _, h := range hits {
+		gm := h.GroupMember
+		gm.Name, gm.Alias, gm.AliasInGroup = h.Highlighted["name"], h.Highlighted["alias"], h.Highlighted["alias_in_group"]
 		results = append(results, gm)
 	}
-	if err := rows.Err(); err != nil {
-		log.Printf("SearchGroupMembers rows error: %v", err)
-		return results, err
-	}
-	return results, nil
+	return results, err
+}
+
+// SearchGroupMemberHits is like SearchGroupMembers but keeps the raw values and reports matched spans.
+func SearchGroupMemberHits(db *sql.DB, clause string, opts HighlightOptions) ([]GroupMemberHit, error) {
+	return SearchGroupMemberHitsContext(context.Background(), db, clause, opts)
+}
+
+// SearchGroupMemberHitsContext is SearchGroupMemberHits with a context.
+func SearchGroupMemberHitsContext(ctx context.Context, db *sql.DB, clause string, opts HighlightOptions) ([]GroupMemberHit, error) {
+	p, err := SearchGroupMemberPageContext(ctx, db, clause, opts, SearchOptions{})
+	return p.Hits, err
+}
+
+// SearchGroupMemberPage returns one page of SearchGroupMemberHits.
+func SearchGroupMemberPage(db *sql.DB, clause string, opts HighlightOptions, page SearchOptions) (Page[GroupMemberHit], error) {
+	return SearchGroupMemberPageContext(context.Background(), db, clause, opts, page)
+}
+
+// SearchGroupMemberPageContext is SearchGroupMemberPage with a context.
+func SearchGroupMemberPageContext(ctx context.Context, db *sql.DB, clause string, opts HighlightOptions, page SearchOptions) (Page[GroupMemberHit], error) {
+	p, err := groupMemberCollection.SearchContext(ctx, db, clause, opts, page)
+	return mapPage(p, func(h Hit[GroupMember]) GroupMemberHit {
+		return GroupMemberHit{GroupMember: h.Value, Spans: h.Spans, Highlighted: h.Highlighted, Score: h.Score}
+	}), err
 }
 
-// SeedGroupMembers inserts example group members for seeded chat groups.
-// Safe to call multiple times; individual insert errors are logged but not fatal.
+// SeedGroupMembers upserts example group members for seeded chat groups.
+// It runs in one transaction and is idempotent; individual upsert errors are logged to Logger but not fatal.
 func SeedGroupMembers(db *sql.DB) error {
+	return SeedGroupMembersContext(context.Background(), db)
+}
+
+// SeedGroupMembersContext is SeedGroupMembers with a context.
+func SeedGroupMembersContext(ctx context.Context, db *sql.DB) error {
 	members := []GroupMember{
 		// Members for group 1 (开发组)
 		{Gid: 1, Uid: 101, Name: "李雷", Alias: "lilei", AliasInGroup: "李"},
@@ -122,10 +197,10 @@ func SeedGroupMembers(db *sql.DB) error {
 		{Gid: 1001, Uid: 10002, Name: "小明", Alias: "xiaoming", AliasInGroup: "小明2"},
 	}
 
-	for _, m := range members {
-		if err := InsertGroupMember(db, m); err != nil {
-			log.Printf("SeedGroupMembers: failed to insert gid=%d uid=%d name=%q: %v", m.Gid, m.Uid, m.Name, err)
-		}
+	res, err := UpsertGroupMembersContext(ctx, db, members, BestEffort)
+	for _, f := range res.Failed {
+		m := members[f.Index]
+		logf("SeedGroupMembers: failed to upsert gid=%d uid=%d name=%q: %v", m.Gid, m.Uid, m.Name, f.Err)
 	}
-	return nil
+	return err
 }
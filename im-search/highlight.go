@@ -0,0 +1,159 @@
+package im_search
+
+import (
+	"html"
+	"strconv"
+	"strings"
+
+	"github.com/chrwhy/simple/examples/go/qparser"
+)
+
+// Span marks a matched range of a raw field value, counted in runes.
+type Span = qparser.Span
+
+// HighlightOptions controls how matched spans are rendered into strings.
+type HighlightOptions struct {
+	Open  string
+	Close string
+	// EscapeHTML escapes the field text, but not Open and Close, for use in HTML output.
+	EscapeHTML bool
+	// PinyinQuery, when set, is the raw query used to mark the hanzi of Pinyin columns that
+	// simple_highlight left unmarked because the match happened on pinyin (see PinyinHighlight).
+	PinyinQuery string
+}
+
+// DefaultHighlightOptions renders matches the way the Search* functions always have.
+var DefaultHighlightOptions = HighlightOptions{Open: "[", Close: "]"}
+
+// Sentinel markers passed to simple_highlight so spans can be recovered from its output
+// even when the text itself contains the caller's markers.
+const (
+	spanOpen  = '\x02'
+	spanClose = '\x03'
+)
+
+// highlightColumn returns the simple_highlight call marking column col of the FTS5 index
+// of table with sentinels.
+func highlightColumn(table string, col int) string {
+	return ftsHighlight + "(" + ftsTable(table) + ", " + strconv.Itoa(col) + ", char(2), char(3))"
+}
+
+// parseSpans recovers the matched spans of raw from the sentinel-marked output of simple_highlight.
+// It returns nil when marked is not raw with markers added.
+func parseSpans(raw, marked string) []Span {
+	var spans []Span
+	var plain strings.Builder
+	pos, start := 0, -1
+	for _, r := range marked {
+		switch r {
+		case spanOpen:
+			start = pos
+		case spanClose:
+			if start >= 0 && pos > start {
+				spans = append(spans, Span{Start: start, Length: pos - start})
+			}
+			start = -1
+		default:
+			plain.WriteRune(r)
+			pos++
+		}
+	}
+	if plain.String() != raw {
+		return nil
+	}
+	return spans
+}
+
+// RenderHighlight wraps the spans of raw in opts.Open and opts.Close.
+func RenderHighlight(raw string, spans []Span, opts HighlightOptions) string {
+	escape := func(s string) string {
+		if opts.EscapeHTML {
+			return html.EscapeString(s)
+		}
+		return s
+	}
+	if len(spans) == 0 {
+		return escape(raw)
+	}
+	runes := []rune(raw)
+	var b strings.Builder
+	pos := 0
+	for _, s := range spans {
+		b.WriteString(escape(string(runes[pos:s.Start])))
+		b.WriteString(opts.Open)
+		b.WriteString(escape(string(runes[s.Start : s.Start+s.Length])))
+		b.WriteString(opts.Close)
+		pos = s.Start + s.Length
+	}
+	b.WriteString(escape(string(runes[pos:])))
+	return b.String()
+}
+
+// highlightFields fills spans and highlighted for every column from its raw and sentinel-marked value.
+// Columns in pinyin without a match get pinyin spans when opts.PinyinQuery is set.
+func highlightFields(columns []string, pinyin map[string]bool, raw, marked []string, opts HighlightOptions) (map[string][]Span, map[string]string) {
+	spans := make(map[string][]Span, len(columns))
+	highlighted := make(map[string]string, len(columns))
+	for i, col := range columns {
+		s := parseSpans(raw[i], marked[i])
+		if len(s) == 0 && pinyin[col] && opts.PinyinQuery != "" {
+			s = qparser.MatchPinyinSpans(raw[i], opts.PinyinQuery)
+		}
+		spans[col] = s
+		highlighted[col] = RenderHighlight(raw[i], s, opts)
+	}
+	return spans, highlighted
+}
+
+// PinyinHighlight returns field unchanged when it already holds a match marked with
+// DefaultHighlightOptions. Otherwise it marks the hanzi whose pinyin or initials the raw
+// query matched, so a search for "zs" that only hit the alias still highlights the name:
+// "张三" becomes "[张][三]". Brackets around text the query does not match are taken as
+// part of the field, not as a match.
+func PinyinHighlight(field, query string) string {
+	opts := DefaultHighlightOptions
+	if hasMarkedMatch(field, query, opts) {
+		return field
+	}
+	return qparser.HighlightPinyin(field, query, opts.Open, opts.Close)
+}
+
+// hasMarkedMatch reports whether field holds text matched by query between opts.Open and
+// opts.Close.
+func hasMarkedMatch(field, query string, opts HighlightOptions) bool {
+	for {
+		_, after, ok := strings.Cut(field, opts.Open)
+		if !ok {
+			return false
+		}
+		marked, rest, ok := strings.Cut(after, opts.Close)
+		if !ok {
+			return false
+		}
+		if len(qparser.MatchPinyinSpans(marked, query)) > 0 {
+			return true
+		}
+		field = rest
+	}
+}
+
+// HighlightContactNames applies PinyinHighlight to the Name of every contact.
+func HighlightContactNames(contacts []Contact, query string) {
+	for i := range contacts {
+		contacts[i].Name = PinyinHighlight(contacts[i].Name, query)
+	}
+}
+
+// HighlightChatGroupNames applies PinyinHighlight to the Name of every chat group.
+func HighlightChatGroupNames(groups []ChatGroup, query string) {
+	for i := range groups {
+		groups[i].Name = PinyinHighlight(groups[i].Name, query)
+	}
+}
+
+// HighlightGroupMemberNames applies PinyinHighlight to the Name of every group member.
+func HighlightGroupMemberNames(members []GroupMember, query string) {
+	for i := range members {
+		members[i].Name = PinyinHighlight(members[i].Name, query)
+	}
+}
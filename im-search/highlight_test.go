@@ -0,0 +1,29 @@
+package im_search
+
+import (
+	"testing"
+
+	"github.com/chrwhy/simple/examples/go/qparser"
+)
+
+func TestPinyinHighlight(t *testing.T) {
+	if err := qparser.LoadHanziPinyin("../" + qparser.DefaultHanziPinyinDict); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		field, query, want string
+	}{
+		{"张三", "zs", "[张][三]"},
+		{"张三", "zhangsan", "[张][三]"},
+		// Already marked by simple_highlight.
+		{"[张]三", "zs", "[张]三"},
+		// Brackets that are part of the name.
+		{"[组长]张三", "zs", "[组长][张][三]"},
+		{"[x]", "zs", "[x]"},
+	}
+	for _, tt := range tests {
+		if got := PinyinHighlight(tt.field, tt.query); got != tt.want {
+			t.Errorf("PinyinHighlight(%q, %q) = %q, want %q", tt.field, tt.query, got, tt.want)
+		}
+	}
+}
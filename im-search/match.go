@@ -0,0 +1,104 @@
+package im_search
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"sync"
+)
+
+// columnMatch returns a WHERE condition that matches the FTS5 expression expr against
+// columns of the FTS5 index of table with a single MATCH and an FTS5 column filter,
+// {name alias} : (expr), so SQLite answers it with one full-text index scan. The filtered expression is
+// returned as the argument to bind; expr never becomes part of the SQL text.
+func columnMatch(table string, columns []string, expr string) (string, []any) {
+	return ftsTable(table) + " MATCH ?", []any{"{" + strings.Join(columns, " ") + "} : (" + expr + ")"}
+}
+
+type stmtKey struct {
+	db    *sql.DB
+	query string
+}
+
+type cachedStmt struct {
+	key     stmtKey
+	stmt    *sql.Stmt
+	refs    int  // callers using stmt
+	evicted bool // closed once refs drops to 0
+}
+
+// stmtCacheSize bounds the number of prepared statements kept across all databases.
+const stmtCacheSize = 128
+
+// stmtCache holds the prepared statements of searches, keyed by database and SQL text,
+// and closes the least recently used one when it holds more than stmtCacheSize. Lists of
+// values are bound as a single JSON argument (see jsonList), so the SQL text of searches
+// comes from a small set.
+var stmtCache = struct {
+	sync.Mutex
+	lru   *list.List // of *cachedStmt, most recently used first
+	byKey map[stmtKey]*list.Element
+}{lru: list.New(), byKey: make(map[stmtKey]*list.Element)}
+
+// prepared returns a cached prepared statement for query on db, preparing it on first use.
+// The caller must call release once done with the statement and the rows it returned.
+func prepared(ctx context.Context, db *sql.DB, query string) (stmt *sql.Stmt, release func(), err error) {
+	key := stmtKey{db, query}
+	stmtCache.Lock()
+	c := cachedLocked(key)
+	stmtCache.Unlock()
+	if c != nil {
+		return c.stmt, c.release, nil
+	}
+
+	stmt, err = db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	stmtCache.Lock()
+	defer stmtCache.Unlock()
+	if c := cachedLocked(key); c != nil {
+		stmt.Close()
+		return c.stmt, c.release, nil
+	}
+	c = &cachedStmt{key: key, stmt: stmt, refs: 1}
+	stmtCache.byKey[key] = stmtCache.lru.PushFront(c)
+	for stmtCache.lru.Len() > stmtCacheSize {
+		old := stmtCache.lru.Remove(stmtCache.lru.Back()).(*cachedStmt)
+		delete(stmtCache.byKey, old.key)
+		old.evicted = true
+		if old.refs == 0 {
+			old.stmt.Close()
+		}
+	}
+	return c.stmt, c.release, nil
+}
+
+// cachedLocked returns the cached statement of key, marked used, or nil. stmtCache must be locked.
+func cachedLocked(key stmtKey) *cachedStmt {
+	e, ok := stmtCache.byKey[key]
+	if !ok {
+		return nil
+	}
+	stmtCache.lru.MoveToFront(e)
+	c := e.Value.(*cachedStmt)
+	c.refs++
+	return c
+}
+
+func (c *cachedStmt) release() {
+	stmtCache.Lock()
+	defer stmtCache.Unlock()
+	c.refs--
+	if c.evicted && c.refs == 0 {
+		c.stmt.Close()
+	}
+}
+
+// jsonList returns values as a JSON array, to bind to "IN (SELECT value FROM json_each(?))".
+func jsonList[T any](values []T) string {
+	b, _ := json.Marshal(values)
+	return string(b)
+}
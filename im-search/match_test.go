@@ -0,0 +1,58 @@
+package im_search
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+var hostileInputs = []string{
+	`'); DROP TABLE contact; --`,
+	`"`,
+	`*`,
+	`OR`,
+	`{uid}:`,
+	`NEAR(`,
+	`name:x) OR 1=1 --`,
+}
+
+func TestSearchHostileInputs(t *testing.T) {
+	db := openTestDB(t)
+	seed(t, db)
+	before := rowCounts(t, db)
+
+	searches := map[string]func(q string) error{
+		"SearchContactPage": func(q string) error {
+			_, err := SearchContactPage(db, q, DefaultHighlightOptions, SearchOptions{WithTotal: true})
+			return err
+		},
+		"SearchChatGroupPage": func(q string) error {
+			_, err := SearchChatGroupPage(db, q, DefaultHighlightOptions, SearchOptions{WithTotal: true})
+			return err
+		},
+		"SearchGroupMemberPage": func(q string) error {
+			_, err := SearchGroupMemberPage(db, q, DefaultHighlightOptions, SearchOptions{WithTotal: true})
+			return err
+		},
+		"SearchChatMessagesFiltered": func(q string) error {
+			filter := MessageFilter{MsgTypes: []string{q}, Conversations: []Conversation{{SubjectType: q, SubjectId: 1}}}
+			_, err := SearchChatMessagesFiltered(db, q, filter, DefaultHighlightOptions, SearchOptions{WithTotal: true})
+			if err != nil {
+				return err
+			}
+			_, err = SearchChatMessagesFiltered(db, q, MessageFilter{}, DefaultHighlightOptions, SearchOptions{WithTotal: true})
+			return err
+		},
+	}
+	for name, search := range searches {
+		for _, q := range hostileInputs {
+			if err := search(q); err != nil && !errors.Is(err, ErrInvalidQuery) {
+				t.Errorf("%s(%q) = %v, want nil or ErrInvalidQuery", name, q, err)
+			}
+		}
+	}
+
+	if after := rowCounts(t, db); !reflect.DeepEqual(after, before) {
+		t.Errorf("row counts changed:\nbefore %v\nafter  %v", before, after)
+	}
+}
@@ -0,0 +1,219 @@
+package im_search
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"unicode"
+)
+
+// dbtx is implemented by both *sql.DB and *sql.Tx.
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// CreateMentionTable creates the table linking group messages to the members they @mention.
+func CreateMentionTable(db *sql.DB) error {
+	return CreateMentionTableContext(context.Background(), db)
+}
+
+// CreateMentionTableContext is CreateMentionTable with a context.
+func CreateMentionTableContext(ctx context.Context, db *sql.DB) error {
+	return opError("CreateMentionTable", createMentionTable(ctx, db))
+}
+
+func createMentionTable(ctx context.Context, db dbtx) error {
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS chat_message_mention (cid INTEGER NOT NULL, uid INTEGER NOT NULL, PRIMARY KEY (cid, uid));`,
+		`CREATE INDEX IF NOT EXISTS idx_chat_message_mention_uid ON chat_message_mention(uid, cid);`,
+	}
+	for _, stmt := range stmts {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MentionCandidates returns the text following every '@' in message, up to the next space
+// or punctuation. Names are often followed by text without a space ("@张三请看"), so a
+// candidate may be longer than the name it mentions; see ResolveMentions.
+func MentionCandidates(message string) []string {
+	var candidates []string
+	runes := []rune(message)
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != '@' {
+			continue
+		}
+		j := i + 1
+		for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_' || runes[j] == '-') {
+			j++
+		}
+		if j > i+1 {
+			candidates = append(candidates, string(runes[i+1:j]))
+		}
+		i = j - 1
+	}
+	return candidates
+}
+
+// ResolveMentions returns the uids of the members mentioned in message. Every candidate
+// resolves to the member whose name, alias or alias_in_group is its longest prefix,
+// compared case-insensitively. Stored mentions use the members of the group when the
+// message was written; see RebuildMentions.
+func ResolveMentions(message string, members []GroupMember) []int {
+	var uids []int
+	seen := make(map[int]bool)
+	for _, candidate := range MentionCandidates(message) {
+		candidate = strings.ToLower(candidate)
+		best, bestLen := 0, 0
+		for _, m := range members {
+			for _, name := range []string{m.Name, m.Alias, m.AliasInGroup} {
+				name = strings.ToLower(name)
+				if name != "" && len(name) > bestLen && strings.HasPrefix(candidate, name) {
+					best, bestLen = m.Uid, len(name)
+				}
+			}
+		}
+		if bestLen > 0 && !seen[best] {
+			seen[best] = true
+			uids = append(uids, best)
+		}
+	}
+	return uids
+}
+
+// indexMentions replaces the mentions stored for m with those found in its message.
+// Only group messages have mentions. They are resolved against the members of the group
+// at the time m is written; see RebuildMentions.
+func indexMentions(ctx context.Context, db dbtx, m ChatMessage) error {
+	if m.SubjectType != "group" || !strings.Contains(m.Message, "@") {
+		_, err := db.ExecContext(ctx, `DELETE FROM chat_message_mention WHERE cid = ?;`, m.Cid)
+		return err
+	}
+	members, err := groupMembers(ctx, db, m.SubjectId)
+	if err != nil {
+		return err
+	}
+	return storeMentions(ctx, db, m, members)
+}
+
+// storeMentions replaces the mentions stored for m with those of members found in its message.
+func storeMentions(ctx context.Context, db dbtx, m ChatMessage, members []GroupMember) error {
+	if _, err := db.ExecContext(ctx, `DELETE FROM chat_message_mention WHERE cid = ?;`, m.Cid); err != nil {
+		return err
+	}
+	for _, uid := range ResolveMentions(m.Message, members) {
+		if _, err := db.ExecContext(ctx, `INSERT OR IGNORE INTO chat_message_mention(cid, uid) VALUES (?, ?);`, m.Cid, uid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groupMembers returns the members of the group gid.
+func groupMembers(ctx context.Context, db dbtx, gid int) ([]GroupMember, error) {
+	rows, err := db.QueryContext(ctx, `SELECT gid, uid, name, alias, alias_in_group FROM group_member WHERE gid = ?;`, gid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var members []GroupMember
+	for rows.Next() {
+		var gm GroupMember
+		if err := rows.Scan(&gm.Gid, &gm.Uid, &gm.Name, &gm.Alias, &gm.AliasInGroup); err != nil {
+			return nil, err
+		}
+		members = append(members, gm)
+	}
+	return members, rows.Err()
+}
+
+// RebuildMentions resolves the mentions of every message in the group gid again against
+// its current members. Mentions are resolved when a message is written, so a member who
+// joins or is renamed later is only linked to earlier messages by this rebuild; members
+// who left keep their mentions until it runs.
+func RebuildMentions(db *sql.DB, gid int) error {
+	return RebuildMentionsContext(context.Background(), db, gid)
+}
+
+// RebuildMentionsContext is RebuildMentions with a context.
+func RebuildMentionsContext(ctx context.Context, db *sql.DB, gid int) error {
+	return opError("RebuildMentions", inTx(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+		members, err := groupMembers(ctx, tx, gid)
+		if err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, `SELECT cid, message FROM chat_message WHERE subject_type = 'group' AND subject_id = ?;`, gid)
+		if err != nil {
+			return err
+		}
+		var messages []ChatMessage
+		for rows.Next() {
+			m := ChatMessage{SubjectType: "group", SubjectId: gid}
+			if err := rows.Scan(&m.Cid, &m.Message); err != nil {
+				rows.Close()
+				return err
+			}
+			messages = append(messages, m)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, m := range messages {
+			if err := storeMentions(ctx, tx, m, members); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+// GetMentions returns the uids mentioned by the message cid.
+func GetMentions(db *sql.DB, cid int) ([]int, error) {
+	return GetMentionsContext(context.Background(), db, cid)
+}
+
+// GetMentionsContext is GetMentions with a context.
+func GetMentionsContext(ctx context.Context, db *sql.DB, cid int) ([]int, error) {
+	rows, err := db.QueryContext(ctx, `SELECT uid FROM chat_message_mention WHERE cid = ? ORDER BY uid;`, cid)
+	if err != nil {
+		return nil, opError("GetMentions", err)
+	}
+	defer rows.Close()
+	var uids []int
+	for rows.Next() {
+		var uid int
+		if err := rows.Scan(&uid); err != nil {
+			return uids, opError("GetMentions", err)
+		}
+		uids = append(uids, uid)
+	}
+	return uids, opError("GetMentions", rows.Err())
+}
+
+// SearchMessagesMentioning returns the messages mentioning uid that contain every term of q,
+// as in SearchChatMessagesFiltered. With an empty q every message mentioning uid is listed;
+// sort those with ByTime.
+func SearchMessagesMentioning(db *sql.DB, uid int, q string, opts HighlightOptions, page SearchOptions) (Page[ChatMessageHit], error) {
+	return SearchMessagesMentioningContext(context.Background(), db, uid, q, opts, page)
+}
+
+// SearchMessagesMentioningContext is SearchMessagesMentioning with a context.
+func SearchMessagesMentioningContext(ctx context.Context, db *sql.DB, uid int, q string, opts HighlightOptions, page SearchOptions) (Page[ChatMessageHit], error) {
+	return SearchChatMessagesFilteredContext(ctx, db, q, MessageFilter{MentionUids: []int{uid}}, opts, page)
+}
+
+// SearchMessagesMentioningAsViewer is SearchMessagesMentioning restricted to the
+// conversations viewerUid belongs to (see MessageFilter.ViewerUid).
+func SearchMessagesMentioningAsViewer(db *sql.DB, viewerUid, uid int, q string, opts HighlightOptions, page SearchOptions) (Page[ChatMessageHit], error) {
+	return SearchMessagesMentioningAsViewerContext(context.Background(), db, viewerUid, uid, q, opts, page)
+}
+
+// SearchMessagesMentioningAsViewerContext is SearchMessagesMentioningAsViewer with a context.
+func SearchMessagesMentioningAsViewerContext(ctx context.Context, db *sql.DB, viewerUid, uid int, q string, opts HighlightOptions, page SearchOptions) (Page[ChatMessageHit], error) {
+	return SearchChatMessagesFilteredContext(ctx, db, q, MessageFilter{MentionUids: []int{uid}, ViewerUid: viewerUid}, opts, page)
+}
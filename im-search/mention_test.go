@@ -0,0 +1,113 @@
+package im_search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSearchMessagesMentioningAsViewer(t *testing.T) {
+	db := openTestDB(t)
+	seedContactRows(t, db)
+	// Group 20 mentions uid 2 without listing it as a member.
+	if err := InsertChatMessage(db, ChatMessage{Cid: 200, SubjectType: "group", SubjectId: 20, SenderUid: 1, Message: "@李四 不在这个群"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT OR IGNORE INTO chat_message_mention(cid, uid) VALUES (200, 2);`); err != nil {
+		t.Fatal(err)
+	}
+
+	cids := func(viewerUid int) []int {
+		t.Helper()
+		p, err := SearchMessagesMentioningAsViewer(db, viewerUid, 2, "", DefaultHighlightOptions, SearchOptions{Order: ByTime})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cids []int
+		for _, h := range p.Hits {
+			cids = append(cids, h.Cid)
+		}
+		return cids
+	}
+	if got, want := cids(2), []int{101}; !reflect.DeepEqual(got, want) {
+		t.Errorf("mentions of 2 seen by 2 = %v, want %v", got, want)
+	}
+	if got := cids(3); len(got) > 0 {
+		t.Errorf("mentions of 2 seen by 3 = %v, want none", got)
+	}
+}
+
+func TestMentionCandidates(t *testing.T) {
+	tests := []struct {
+		message string
+		want    []string
+	}{
+		{"no mentions", nil},
+		{"@张三 @li_si, @wang-wu!", []string{"张三", "li_si", "wang-wu"}},
+		{"@张三请看", []string{"张三请看"}},
+		{"mail a@b.c", []string{"b"}},
+		{"@ alone and @@bob", []string{"bob"}},
+	}
+	for _, tt := range tests {
+		if got := MentionCandidates(tt.message); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("MentionCandidates(%q) = %q, want %q", tt.message, got, tt.want)
+		}
+	}
+}
+
+func TestResolveMentions(t *testing.T) {
+	members := []GroupMember{
+		{Uid: 1, Name: "张三"},
+		{Uid: 2, Name: "张三丰"},
+		{Uid: 3, Name: "Bob", Alias: "bobby", AliasInGroup: "组长"},
+	}
+	tests := []struct {
+		message string
+		want    []int
+	}{
+		{"@张三请看", []int{1}},
+		{"@张三丰 你好", []int{2}},
+		{"@BOB @bobby @组长", []int{3}},
+		{"@组长 @张三", []int{3, 1}},
+		{"@李四", nil},
+	}
+	for _, tt := range tests {
+		if got := ResolveMentions(tt.message, members); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ResolveMentions(%q) = %v, want %v", tt.message, got, tt.want)
+		}
+	}
+}
+
+func TestRebuildMentions(t *testing.T) {
+	db := openTestDB(t)
+	if err := InsertGroupMember(db, GroupMember{Gid: 10, Uid: 1, Name: "张三"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := InsertChatMessage(db, ChatMessage{Cid: 1, SubjectType: "group", SubjectId: 10, Message: "@张三 @李四 开会"}); err != nil {
+		t.Fatal(err)
+	}
+	mentions := func() []int {
+		t.Helper()
+		uids, err := GetMentions(db, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return uids
+	}
+	if got, want := mentions(), []int{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("mentions = %v, want %v", got, want)
+	}
+
+	// A member who joins later is not linked until the mentions are rebuilt.
+	if err := InsertGroupMember(db, GroupMember{Gid: 10, Uid: 2, Name: "李四"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mentions(), []int{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("mentions before rebuild = %v, want %v", got, want)
+	}
+	if err := RebuildMentions(db, 10); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mentions(), []int{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("mentions after rebuild = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,89 @@
+package im_search
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// MessageContext is a message with its neighbors in the same conversation.
+type MessageContext struct {
+	Before  []ChatMessage // messages sent before Message, oldest first
+	Message ChatMessage
+	After   []ChatMessage // messages sent after Message, oldest first
+}
+
+// GetMessageContext returns the message cid with up to before messages preceding it and up
+// to after messages following it in the same conversation, direct or group. Messages are
+// ordered by sent_at, with cid ordering messages sent at the same time. A negative before
+// or after counts as 0. It fails with ErrNotFound when cid does not exist.
+func GetMessageContext(db *sql.DB, cid, before, after int) (MessageContext, error) {
+	return GetMessageContextContext(context.Background(), db, cid, before, after)
+}
+
+// GetMessageContextContext is GetMessageContext with a context.
+func GetMessageContextContext(ctx context.Context, db *sql.DB, cid, before, after int) (MessageContext, error) {
+	mc, err := getMessageContext(ctx, db, 0, cid, before, after)
+	return mc, opError("GetMessageContext", err)
+}
+
+// GetMessageContextAsViewer is GetMessageContext failing with ErrNotFound unless viewerUid
+// belongs to the message's conversation (see MessageFilter.ViewerUid).
+func GetMessageContextAsViewer(db *sql.DB, viewerUid, cid, before, after int) (MessageContext, error) {
+	return GetMessageContextAsViewerContext(context.Background(), db, viewerUid, cid, before, after)
+}
+
+// GetMessageContextAsViewerContext is GetMessageContextAsViewer with a context.
+func GetMessageContextAsViewerContext(ctx context.Context, db *sql.DB, viewerUid, cid, before, after int) (MessageContext, error) {
+	mc, err := getMessageContext(ctx, db, viewerUid, cid, before, after)
+	return mc, opError("GetMessageContextAsViewer", err)
+}
+
+func getMessageContext(ctx context.Context, db *sql.DB, viewerUid, cid, before, after int) (MessageContext, error) {
+	var mc MessageContext
+	// SQLite reads a negative LIMIT as no limit at all.
+	before, after = max(before, 0), max(after, 0)
+	columns := `cid, subject_id, subject_type, message, sender_uid, sent_at, msg_type`
+	where, args := MessageFilter{Cids: []int{cid}, ViewerUid: viewerUid}.where()
+	found, err := queryChatMessages(ctx, db, `SELECT `+columns+` FROM chat_message WHERE `+where+` LIMIT 1;`, args...)
+	if err != nil {
+		return mc, err
+	}
+	if len(found) == 0 {
+		return mc, fmt.Errorf("chat_message cid=%d %w", cid, ErrNotFound)
+	}
+	m := found[0]
+	mc.Message = m
+
+	beforeSQL := `SELECT ` + columns + ` FROM chat_message WHERE subject_type = ? AND subject_id = ? AND (sent_at, cid) < (?, ?) ORDER BY sent_at DESC, cid DESC LIMIT ?;`
+	mc.Before, err = queryChatMessages(ctx, db, beforeSQL, m.SubjectType, m.SubjectId, m.SentAt, m.Cid, before)
+	if err != nil {
+		return mc, err
+	}
+	for i, j := 0, len(mc.Before)-1; i < j; i, j = i+1, j-1 {
+		mc.Before[i], mc.Before[j] = mc.Before[j], mc.Before[i]
+	}
+
+	afterSQL := `SELECT ` + columns + ` FROM chat_message WHERE subject_type = ? AND subject_id = ? AND (sent_at, cid) > (?, ?) ORDER BY sent_at, cid LIMIT ?;`
+	mc.After, err = queryChatMessages(ctx, db, afterSQL, m.SubjectType, m.SubjectId, m.SentAt, m.Cid, after)
+	return mc, err
+}
+
+// queryChatMessages runs a query selecting every chat_message column in table order.
+func queryChatMessages(ctx context.Context, db *sql.DB, query string, args ...any) ([]ChatMessage, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []ChatMessage
+	for rows.Next() {
+		var m ChatMessage
+		if err := rows.Scan(&m.Cid, &m.SubjectId, &m.SubjectType, &m.Message, &m.SenderUid, &m.SentAt, &m.MsgType); err != nil {
+			return results, err
+		}
+		results = append(results, m)
+	}
+	return results, rows.Err()
+}
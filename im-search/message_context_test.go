@@ -0,0 +1,62 @@
+package im_search
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestGetMessageContext(t *testing.T) {
+	db := openTestDB(t)
+	// Messages 2 and 3 are sent at the same time and ordered by cid; message 9 belongs to
+	// another conversation.
+	msgs := []ChatMessage{
+		{Cid: 1, SubjectType: "contact", SubjectId: 1, Message: "one", SentAt: 100},
+		{Cid: 3, SubjectType: "contact", SubjectId: 1, Message: "three", SentAt: 200},
+		{Cid: 2, SubjectType: "contact", SubjectId: 1, Message: "two", SentAt: 200},
+		{Cid: 4, SubjectType: "contact", SubjectId: 1, Message: "four", SentAt: 300},
+		{Cid: 9, SubjectType: "contact", SubjectId: 2, Message: "other", SentAt: 250},
+	}
+	if _, err := InsertChatMessages(db, msgs, AllOrNothing); err != nil {
+		t.Fatal(err)
+	}
+	cids := func(ms []ChatMessage) []int {
+		var ids []int
+		for _, m := range ms {
+			ids = append(ids, m.Cid)
+		}
+		return ids
+	}
+
+	tests := []struct {
+		cid, before, after int
+		wantBefore         []int
+		wantAfter          []int
+	}{
+		{cid: 1, before: 2, after: 2, wantAfter: []int{2, 3}},
+		{cid: 4, before: 2, after: 2, wantBefore: []int{2, 3}},
+		{cid: 2, before: 5, after: 5, wantBefore: []int{1}, wantAfter: []int{3, 4}},
+		{cid: 3, before: 1, after: 0, wantBefore: []int{2}},
+		{cid: 3, before: -1, after: -1},
+	}
+	for _, tt := range tests {
+		mc, err := GetMessageContext(db, tt.cid, tt.before, tt.after)
+		if err != nil {
+			t.Errorf("GetMessageContext(%d, %d, %d) error = %v", tt.cid, tt.before, tt.after, err)
+			continue
+		}
+		if mc.Message.Cid != tt.cid {
+			t.Errorf("GetMessageContext(%d, %d, %d).Message.Cid = %d", tt.cid, tt.before, tt.after, mc.Message.Cid)
+		}
+		if got := cids(mc.Before); !reflect.DeepEqual(got, tt.wantBefore) {
+			t.Errorf("GetMessageContext(%d, %d, %d).Before = %v, want %v", tt.cid, tt.before, tt.after, got, tt.wantBefore)
+		}
+		if got := cids(mc.After); !reflect.DeepEqual(got, tt.wantAfter) {
+			t.Errorf("GetMessageContext(%d, %d, %d).After = %v, want %v", tt.cid, tt.before, tt.after, got, tt.wantAfter)
+		}
+	}
+
+	if _, err := GetMessageContext(db, 42, 1, 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetMessageContext of a missing cid error = %v, want ErrNotFound", err)
+	}
+}
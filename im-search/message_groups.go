@@ -0,0 +1,209 @@
+package im_search
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+)
+
+// ConversationHits summarizes the hits of a message search within one conversation.
+type ConversationHits struct {
+	Conversation
+	DisplayName string // chat group name or contact name; empty when neither exists
+	HitCount    int
+	// Best is the conversation's first hit in the search order, with Snippet set. Only its
+	// Cid is set when the page is Truncated before the hits were read.
+	Best ChatMessageHit
+}
+
+// SearchChatMessagesGrouped runs a message search like SearchChatMessagesQuery but returns
+// one entry per conversation, "N related messages in 开发组", ordered by each conversation's
+// best hit. Use SearchConversationMessages to page through one conversation's hits.
+func SearchChatMessagesGrouped(db *sql.DB, query string, opts SnippetOptions, page SearchOptions) (Page[ConversationHits], error) {
+	return SearchChatMessagesGroupedContext(context.Background(), db, query, opts, page)
+}
+
+// SearchChatMessagesGroupedContext is SearchChatMessagesGrouped with a context.
+func SearchChatMessagesGroupedContext(ctx context.Context, db *sql.DB, query string, opts SnippetOptions, page SearchOptions) (Page[ConversationHits], error) {
+	p, err := searchChatMessagesGrouped(ctx, db, 0, query, opts, page)
+	return p, queryError("SearchChatMessagesGrouped", err)
+}
+
+// SearchChatMessagesGroupedAsViewer is SearchChatMessagesGrouped restricted to the
+// conversations viewerUid belongs to (see MessageFilter.ViewerUid).
+func SearchChatMessagesGroupedAsViewer(db *sql.DB, viewerUid int, query string, opts SnippetOptions, page SearchOptions) (Page[ConversationHits], error) {
+	return SearchChatMessagesGroupedAsViewerContext(context.Background(), db, viewerUid, query, opts, page)
+}
+
+// SearchChatMessagesGroupedAsViewerContext is SearchChatMessagesGroupedAsViewer with a context.
+func SearchChatMessagesGroupedAsViewerContext(ctx context.Context, db *sql.DB, viewerUid int, query string, opts SnippetOptions, page SearchOptions) (Page[ConversationHits], error) {
+	p, err := searchChatMessagesGrouped(ctx, db, viewerUid, query, opts, page)
+	return p, queryError("SearchChatMessagesGroupedAsViewer", err)
+}
+
+func searchChatMessagesGrouped(ctx context.Context, db *sql.DB, viewerUid int, query string, opts SnippetOptions, page SearchOptions) (Page[ConversationHits], error) {
+	ctx, cancel := withBudget(ctx, page.Budget)
+	defer cancel()
+	page.Order = page.resolvedOrder("chat_message")
+	p := Page[ConversationHits]{Total: -1}
+	var last pageKey
+	// stop returns err, or the hits so far when the search ran out of its budget.
+	stop := func(err error) (Page[ConversationHits], error) {
+		if !outOfBudget(ctx) {
+			return p, err
+		}
+		p.Total, p.Truncated = -1, true
+		if len(p.Hits) > 0 && p.NextPageToken == "" {
+			p.NextPageToken = encodePageToken(last, page.Order)
+		}
+		return p, nil
+	}
+
+	rest, filter, ok, err := parseMessageQuery(ctx, db, query, viewerUid)
+	if err != nil {
+		return stop(err)
+	}
+	if !ok {
+		return p, nil
+	}
+	after, err := decodePageToken(page.PageToken, page.Order)
+	if err != nil {
+		return p, err
+	}
+
+	clause := messageClause(rest)
+	q := searchQuery{table: "chat_message"}
+	if clause != "" {
+		q.match, q.matchArgs = columnMatch("chat_message", []string{"message"}, clause)
+	}
+	q.filter, q.filterArgs = filter.where()
+	if q.match == "" && q.filter == "" {
+		return p, nil
+	}
+	keyset, orderBy, keysetArgs, err := pageOrder("chat_message", page.Order, after)
+	if err != nil {
+		return p, err
+	}
+
+	bm25, args := "0", []any(nil)
+	if q.match != "" {
+		bm25, args = bm25Column("chat_message", page.Weights)
+	}
+	where, whereArgs := q.where()
+	args = append(args, whereArgs...)
+	args = append(args, keysetArgs...)
+	limit, limitArgs := pageLimit(page)
+	args = append(args, limitArgs...)
+
+	sqlStmt := `WITH hits AS (
+		SELECT rowid AS rid, ` + bm25 + ` AS score, cid, subject_type, subject_id, sent_at FROM ` + q.from() + ` WHERE ` + where + `
+	), ranked AS (
+		SELECT *, count(*) OVER conv AS hit_count, row_number() OVER (conv ORDER BY ` + orderBy + `) AS pos
+		FROM hits WINDOW conv AS (PARTITION BY subject_type, subject_id)
+	)
+	SELECT rid, score, sent_at, subject_type, subject_id, hit_count, cid, coalesce(g.name, c.name, '') FROM ranked
+	LEFT JOIN chat_group g ON subject_type = 'group' AND g.gid = subject_id
+	LEFT JOIN contact c ON subject_type = 'contact' AND c.uid = subject_id
+	WHERE pos = 1 AND ` + keyset + ` ORDER BY ` + orderBy + limit + `;`
+	stmt, release, err := prepared(ctx, db, sqlStmt)
+	if err != nil {
+		return stop(err)
+	}
+	defer release()
+	rows, err := stmt.QueryContext(ctx, args...)
+	if err != nil {
+		return stop(err)
+	}
+	defer rows.Close()
+
+	var cids []int
+	for rows.Next() {
+		if page.Limit > 0 && len(p.Hits) == page.Limit {
+			p.NextPageToken = encodePageToken(last, page.Order)
+			break
+		}
+		var key pageKey
+		var c ConversationHits
+		if err := rows.Scan(&key.Rowid, &key.Score, &key.Time, &c.SubjectType, &c.SubjectId, &c.HitCount, &c.Best.Cid, &c.DisplayName); err != nil {
+			return p, err
+		}
+		last = key
+		cids = append(cids, c.Best.Cid)
+		p.Hits = append(p.Hits, c)
+	}
+	if err := rows.Err(); err != nil {
+		return stop(err)
+	}
+
+	if len(cids) > 0 {
+		best, err := searchChatMessagePage(ctx, db, clause, MessageFilter{Cids: cids}, opts.Highlight, SearchOptions{})
+		if err != nil {
+			return p, err
+		}
+		byCid := make(map[int]ChatMessageHit, len(best.Hits))
+		for _, h := range best.Hits {
+			h.Snippet = Snippet(h.Message, h.Spans["message"], opts)
+			byCid[h.Cid] = h
+		}
+		for i := range p.Hits {
+			if h, ok := byCid[p.Hits[i].Best.Cid]; ok {
+				p.Hits[i].Best = h
+			}
+		}
+		if best.Truncated {
+			return stop(context.Cause(ctx))
+		}
+	}
+
+	if page.WithTotal {
+		err = db.QueryRowContext(ctx, `SELECT count(*) FROM (SELECT 1 FROM `+q.from()+` WHERE `+where+` GROUP BY subject_type, subject_id);`, whereArgs...).Scan(&p.Total)
+		if err != nil {
+			return stop(err)
+		}
+	}
+	return p, nil
+}
+
+// SearchConversationMessages pages through the hits of a message search within one
+// conversation, as returned by SearchChatMessagesGrouped. Every hit has Snippet set. The
+// page is empty when an in: operator of query leaves conv out.
+func SearchConversationMessages(db *sql.DB, query string, conv Conversation, opts SnippetOptions, page SearchOptions) (Page[ChatMessageHit], error) {
+	return SearchConversationMessagesContext(context.Background(), db, query, conv, opts, page)
+}
+
+// SearchConversationMessagesContext is SearchConversationMessages with a context.
+func SearchConversationMessagesContext(ctx context.Context, db *sql.DB, query string, conv Conversation, opts SnippetOptions, page SearchOptions) (Page[ChatMessageHit], error) {
+	return searchConversationMessages(ctx, db, 0, query, conv, opts, page)
+}
+
+// SearchConversationMessagesAsViewer is SearchConversationMessages returning nothing unless
+// viewerUid belongs to conv (see MessageFilter.ViewerUid).
+func SearchConversationMessagesAsViewer(db *sql.DB, viewerUid int, query string, conv Conversation, opts SnippetOptions, page SearchOptions) (Page[ChatMessageHit], error) {
+	return SearchConversationMessagesAsViewerContext(context.Background(), db, viewerUid, query, conv, opts, page)
+}
+
+// SearchConversationMessagesAsViewerContext is SearchConversationMessagesAsViewer with a context.
+func SearchConversationMessagesAsViewerContext(ctx context.Context, db *sql.DB, viewerUid int, query string, conv Conversation, opts SnippetOptions, page SearchOptions) (Page[ChatMessageHit], error) {
+	return searchConversationMessages(ctx, db, viewerUid, query, conv, opts, page)
+}
+
+func searchConversationMessages(ctx context.Context, db *sql.DB, viewerUid int, query string, conv Conversation, opts SnippetOptions, page SearchOptions) (Page[ChatMessageHit], error) {
+	ctx, cancel := withBudget(ctx, page.Budget)
+	defer cancel()
+	rest, filter, ok, err := parseMessageQuery(ctx, db, query, viewerUid)
+	if err != nil && outOfBudget(ctx) {
+		return Page[ChatMessageHit]{Total: -1, Truncated: true}, nil
+	}
+	if err != nil || !ok {
+		return Page[ChatMessageHit]{Total: -1}, err
+	}
+	if len(filter.Conversations) > 0 && !slices.Contains(filter.Conversations, conv) {
+		return Page[ChatMessageHit]{Total: -1}, nil
+	}
+	filter.Conversations = []Conversation{conv}
+	p, err := SearchChatMessagesFilteredContext(ctx, db, rest, filter, opts.Highlight, page)
+	for i := range p.Hits {
+		p.Hits[i].Snippet = Snippet(p.Hits[i].Message, p.Hits[i].Spans["message"], opts)
+	}
+	return p, err
+}
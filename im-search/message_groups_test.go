@@ -0,0 +1,98 @@
+package im_search
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+func seedConversations(t *testing.T) *sql.DB {
+	t.Helper()
+	db := openTestDB(t)
+	if err := InsertChatGroup(db, ChatGroup{Gid: 10, Name: "dev team"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := InsertContact(db, Contact{Uid: 1, Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	msgs := []ChatMessage{
+		{Cid: 1, SubjectType: "group", SubjectId: 10, Message: "review the plan", SentAt: 100},
+		{Cid: 2, SubjectType: "contact", SubjectId: 1, Message: "review my change", SentAt: 200},
+		{Cid: 3, SubjectType: "group", SubjectId: 10, Message: "code review today", SentAt: 300},
+		{Cid: 4, SubjectType: "group", SubjectId: 10, Message: "review done", SentAt: 400},
+		{Cid: 5, SubjectType: "group", SubjectId: 10, Message: "lunch", SentAt: 500},
+	}
+	if _, err := InsertChatMessages(db, msgs, AllOrNothing); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestSearchChatMessagesGrouped(t *testing.T) {
+	db := seedConversations(t)
+	p, err := SearchChatMessagesGrouped(db, "review", DefaultSnippetOptions, SearchOptions{Limit: 10, Order: ByTime})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type summary struct {
+		Conversation
+		DisplayName string
+		HitCount    int
+		Best        int
+	}
+	var got []summary
+	for _, c := range p.Hits {
+		got = append(got, summary{c.Conversation, c.DisplayName, c.HitCount, c.Best.Cid})
+	}
+	want := []summary{
+		{Conversation{"group", 10}, "dev team", 3, 4},
+		{Conversation{"contact", 1}, "alice", 1, 2},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SearchChatMessagesGrouped = %+v, want %+v", got, want)
+	}
+}
+
+func TestSearchConversationMessages(t *testing.T) {
+	db := seedConversations(t)
+	group := Conversation{SubjectType: "group", SubjectId: 10}
+
+	var cids []int
+	page := SearchOptions{Limit: 2, Order: ByTime}
+	for i := 0; ; i++ {
+		p, err := SearchConversationMessages(db, "review", group, DefaultSnippetOptions, page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, h := range p.Hits {
+			if h.Snippet == "" {
+				t.Errorf("hit %d has no snippet", h.Cid)
+			}
+			cids = append(cids, h.Cid)
+		}
+		if p.NextPageToken == "" || i == 5 {
+			break
+		}
+		page.PageToken = p.NextPageToken
+	}
+	if want := []int{4, 3, 1}; !reflect.DeepEqual(cids, want) {
+		t.Errorf("paged cids = %v, want %v", cids, want)
+	}
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"in:dev review", 3},
+		{"in:alice review", 0},
+	}
+	for _, tt := range tests {
+		p, err := SearchConversationMessages(db, tt.query, group, DefaultSnippetOptions, SearchOptions{Limit: 10})
+		if err != nil {
+			t.Fatalf("%q: %v", tt.query, err)
+		}
+		if len(p.Hits) != tt.want {
+			t.Errorf("%q: %d hits, want %d", tt.query, len(p.Hits), tt.want)
+		}
+	}
+}
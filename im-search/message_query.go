@@ -0,0 +1,134 @@
+package im_search
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/chrwhy/simple/examples/go/qparser"
+)
+
+// resolveLimit caps how many contacts, members or groups one from: or in: value resolves to.
+const resolveLimit = 50
+
+// ResolveMessageFilter turns query operators into a MessageFilter. from: values are looked
+// up as contacts and group members, in: values as chat groups and as direct chats with
+// contacts, by name, alias or pinyin just like the entity searches.
+// ok is false when a from: or in: value matched nobody, so no message can satisfy the query.
+func ResolveMessageFilter(db *sql.DB, ops qparser.Operators) (filter MessageFilter, ok bool, err error) {
+	return ResolveMessageFilterContext(context.Background(), db, ops)
+}
+
+// ResolveMessageFilterContext is ResolveMessageFilter with a context. Rather than resolve
+// a value to part of its matches, it fails when a search budget of ctx runs out.
+func ResolveMessageFilterContext(ctx context.Context, db *sql.DB, ops qparser.Operators) (filter MessageFilter, ok bool, err error) {
+	filter.Since, filter.Until = ops.After, ops.Before
+	page := SearchOptions{Limit: resolveLimit, Order: ByRelevance}
+
+	for _, name := range ops.From {
+		clause := parseClause(name)
+		contacts, err := SearchContactPageContext(ctx, db, clause, HighlightOptions{}, page)
+		if err != nil {
+			return filter, false, err
+		}
+		members, err := SearchGroupMemberPageContext(ctx, db, clause, HighlightOptions{}, page)
+		if err != nil {
+			return filter, false, err
+		}
+		if contacts.Truncated || members.Truncated {
+			return filter, false, context.Cause(ctx)
+		}
+		if len(contacts.Hits) == 0 && len(members.Hits) == 0 {
+			return filter, false, nil
+		}
+		for _, c := range contacts.Hits {
+			filter.SenderUids = append(filter.SenderUids, c.Uid)
+		}
+		for _, m := range members.Hits {
+			filter.SenderUids = append(filter.SenderUids, m.Uid)
+		}
+	}
+
+	for _, name := range ops.In {
+		clause := parseClause(name)
+		groups, err := SearchChatGroupPageContext(ctx, db, clause, HighlightOptions{}, page)
+		if err != nil {
+			return filter, false, err
+		}
+		contacts, err := SearchContactPageContext(ctx, db, clause, HighlightOptions{}, page)
+		if err != nil {
+			return filter, false, err
+		}
+		if groups.Truncated || contacts.Truncated {
+			return filter, false, context.Cause(ctx)
+		}
+		if len(groups.Hits) == 0 && len(contacts.Hits) == 0 {
+			return filter, false, nil
+		}
+		for _, g := range groups.Hits {
+			filter.Conversations = append(filter.Conversations, Conversation{SubjectType: "group", SubjectId: g.Gid})
+		}
+		for _, c := range contacts.Hits {
+			filter.Conversations = append(filter.Conversations, Conversation{SubjectType: "contact", SubjectId: c.Uid})
+		}
+	}
+	return filter, true, nil
+}
+
+// SearchChatMessagesQuery searches messages with a query that may contain operators, like
+// "from:张三 in:开发组 after:2026-01-01 review". The operators become a MessageFilter (see
+// ResolveMessageFilter) and the remaining keywords are searched as in SearchChatMessages.
+func SearchChatMessagesQuery(db *sql.DB, query string, opts HighlightOptions, page SearchOptions) (Page[ChatMessageHit], error) {
+	return SearchChatMessagesQueryContext(context.Background(), db, query, opts, page)
+}
+
+// SearchChatMessagesQueryContext is SearchChatMessagesQuery with a context.
+func SearchChatMessagesQueryContext(ctx context.Context, db *sql.DB, query string, opts HighlightOptions, page SearchOptions) (Page[ChatMessageHit], error) {
+	return searchChatMessagesQuery(ctx, db, 0, query, opts, page)
+}
+
+// SearchChatMessagesAsViewer is SearchChatMessagesQuery restricted to the conversations
+// viewerUid belongs to (see MessageFilter.ViewerUid).
+func SearchChatMessagesAsViewer(db *sql.DB, viewerUid int, query string, opts HighlightOptions, page SearchOptions) (Page[ChatMessageHit], error) {
+	return SearchChatMessagesAsViewerContext(context.Background(), db, viewerUid, query, opts, page)
+}
+
+// SearchChatMessagesAsViewerContext is SearchChatMessagesAsViewer with a context.
+func SearchChatMessagesAsViewerContext(ctx context.Context, db *sql.DB, viewerUid int, query string, opts HighlightOptions, page SearchOptions) (Page[ChatMessageHit], error) {
+	return searchChatMessagesQuery(ctx, db, viewerUid, query, opts, page)
+}
+
+func searchChatMessagesQuery(ctx context.Context, db *sql.DB, viewerUid int, query string, opts HighlightOptions, page SearchOptions) (Page[ChatMessageHit], error) {
+	ctx, cancel := withBudget(ctx, page.Budget)
+	defer cancel()
+	rest, filter, ok, err := parseMessageQuery(ctx, db, query, viewerUid)
+	if err != nil && outOfBudget(ctx) {
+		return Page[ChatMessageHit]{Total: -1, Truncated: true}, nil
+	}
+	if err != nil || !ok {
+		return Page[ChatMessageHit]{Total: -1}, err
+	}
+	return SearchChatMessagesFilteredContext(ctx, db, rest, filter, opts, page)
+}
+
+// parseMessageQuery splits the operators off query and resolves them into a filter scoped
+// to viewerUid, which may be 0 for no scope. ok is false when the operators can match no message.
+// Malformed operators fail with ErrInvalidQuery.
+func parseMessageQuery(ctx context.Context, db *sql.DB, query string, viewerUid int) (rest string, filter MessageFilter, ok bool, err error) {
+	ops, rest, err := qparser.ParseOperators(query)
+	if err != nil {
+		return "", filter, false, invalidQuery("ParseOperators", err)
+	}
+	filter, ok, err = ResolveMessageFilterContext(ctx, db, ops)
+	filter.ViewerUid = viewerUid
+	return rest, filter, ok, err
+}
+
+// parseClause is qparser.ParseClause, ignoring repeated and surrounding whitespace.
+func parseClause(query string) string {
+	query = strings.Join(strings.Fields(query), " ")
+	if query == "" {
+		return ""
+	}
+	return qparser.ParseClause(query)
+}
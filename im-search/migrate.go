@@ -0,0 +1,193 @@
+package im_search
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Migration is one version of the im_search schema. Up moves a database from the
+// previous version to Version.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, tx *sql.Tx) error
+}
+
+// Migrations lists every schema version in order. The version of a database is kept in
+// PRAGMA user_version; 0 is a database no migration has run on.
+var Migrations = []Migration{
+	{Version: 1, Name: "base tables with FTS5 indexes, mentions and vocabularies", Up: migrateV1},
+	{Version: 2, Name: "trash for soft-deleted groups and contacts", Up: migrateV2},
+}
+
+// ErrSchemaTooNew is returned when a database was migrated by a newer build.
+var ErrSchemaTooNew = errors.New("database schema is newer than the known migrations")
+
+// SchemaVersion returns the schema version of db.
+func SchemaVersion(db *sql.DB) (int, error) {
+	return SchemaVersionContext(context.Background(), db)
+}
+
+// SchemaVersionContext is SchemaVersion with a context.
+func SchemaVersionContext(ctx context.Context, db *sql.DB) (int, error) {
+	var v int
+	err := db.QueryRowContext(ctx, `PRAGMA user_version;`).Scan(&v)
+	return v, opError("SchemaVersion", err)
+}
+
+// PendingMigrations returns the migrations not yet applied to db, in order.
+func PendingMigrations(db *sql.DB) ([]Migration, error) {
+	return PendingMigrationsContext(context.Background(), db)
+}
+
+// PendingMigrationsContext is PendingMigrations with a context.
+func PendingMigrationsContext(ctx context.Context, db *sql.DB) ([]Migration, error) {
+	v, err := SchemaVersionContext(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if n := len(Migrations); n > 0 && v > Migrations[n-1].Version {
+		return nil, opError("PendingMigrations", fmt.Errorf("%w: version %d", ErrSchemaTooNew, v))
+	}
+	var pending []Migration
+	for _, m := range Migrations {
+		if m.Version > v {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies the pending migrations to db in order and returns those applied.
+// Every migration runs in its own transaction together with the update of user_version,
+// so a failing migration is rolled back and leaves db at the previous version.
+func Migrate(db *sql.DB) ([]Migration, error) {
+	return MigrateContext(context.Background(), db)
+}
+
+// MigrateContext is Migrate with a context.
+func MigrateContext(ctx context.Context, db *sql.DB) ([]Migration, error) {
+	pending, err := PendingMigrationsContext(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	var applied []Migration
+	for _, m := range pending {
+		err := inTx(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+			if err := m.Up(ctx, tx); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, `PRAGMA user_version = `+strconv.Itoa(m.Version)+`;`)
+			return err
+		})
+		if err != nil {
+			return applied, opError("Migrate", fmt.Errorf("version %d (%s): %w", m.Version, m.Name, err))
+		}
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+// migrateV1 creates the base tables, their FTS5 indexes and vocabularies and the mention
+// table. Tables that already exist are kept and legacy standalone FTS5 tables are
+// converted, so it applies to databases made by any earlier build. Its statements are the
+// schema as version 1 shipped it and must not change with the collections: later schema
+// changes go in new migrations.
+func migrateV1(ctx context.Context, tx *sql.Tx) error {
+	for _, t := range v1Tables {
+		stmts := append([]string(nil), t.create...)
+		stmts = append(stmts, strings.ReplaceAll(t.fts, "$tokenize", ftsTokenize))
+		stmts = append(stmts, t.triggers...)
+		if err := convertTable(ctx, tx, t.idx, stmts); err != nil {
+			return err
+		}
+	}
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS chat_message_mention (cid INTEGER NOT NULL, uid INTEGER NOT NULL, PRIMARY KEY (cid, uid));`,
+		`CREATE INDEX IF NOT EXISTS idx_chat_message_mention_uid ON chat_message_mention(uid, cid);`,
+	}
+	for _, t := range v1Tables {
+		stmts = append(stmts, `CREATE VIRTUAL TABLE IF NOT EXISTS `+t.idx.table+`_vocab USING fts5vocab(`+t.idx.table+`_fts, 'row');`)
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// v1Table is a base table of schema version 1 with its FTS5 index. fts declares the index,
+// with $tokenize standing for ftsTokenize.
+type v1Table struct {
+	idx      ftsIndex
+	create   []string
+	fts      string
+	triggers []string
+}
+
+var v1Tables = []v1Table{
+	{
+		idx: ftsIndex{table: "chat_group", columns: []string{"gid", "name", "alias"}, key: []string{"gid"},
+			legacyDefaults: map[string]string{"name": "''", "alias": "''"}},
+		create: []string{
+			`CREATE TABLE IF NOT EXISTS chat_group(gid INTEGER PRIMARY KEY, name TEXT NOT NULL DEFAULT '', alias TEXT NOT NULL DEFAULT '');`,
+		},
+		fts: `CREATE VIRTUAL TABLE IF NOT EXISTS chat_group_fts USING fts5(gid UNINDEXED, name, alias, content = 'chat_group', content_rowid = 'gid', tokenize = '$tokenize');`,
+		triggers: []string{
+			`CREATE TRIGGER IF NOT EXISTS chat_group_ai AFTER INSERT ON chat_group BEGIN INSERT INTO chat_group_fts(rowid, gid, name, alias) VALUES (new.gid, new.gid, new.name, new.alias); END;`,
+			`CREATE TRIGGER IF NOT EXISTS chat_group_ad AFTER DELETE ON chat_group BEGIN INSERT INTO chat_group_fts(chat_group_fts, rowid, gid, name, alias) VALUES ('delete', old.gid, old.gid, old.name, old.alias); END;`,
+			`CREATE TRIGGER IF NOT EXISTS chat_group_au AFTER UPDATE ON chat_group BEGIN INSERT INTO chat_group_fts(chat_group_fts, rowid, gid, name, alias) VALUES ('delete', old.gid, old.gid, old.name, old.alias); INSERT INTO chat_group_fts(rowid, gid, name, alias) VALUES (new.gid, new.gid, new.name, new.alias); END;`,
+		},
+	},
+	{
+		idx: ftsIndex{table: "group_member", columns: []string{"gid", "uid", "name", "alias", "alias_in_group"}, key: []string{"gid", "uid"},
+			legacyDefaults: map[string]string{"name": "''", "alias": "''", "alias_in_group": "''"}},
+		create: []string{
+			`CREATE TABLE IF NOT EXISTS group_member(id INTEGER PRIMARY KEY, gid INTEGER NOT NULL, uid INTEGER NOT NULL, name TEXT NOT NULL DEFAULT '', alias TEXT NOT NULL DEFAULT '', alias_in_group TEXT NOT NULL DEFAULT '', UNIQUE (gid, uid));`,
+			`CREATE INDEX IF NOT EXISTS idx_group_member_uid ON group_member(uid);`,
+		},
+		fts: `CREATE VIRTUAL TABLE IF NOT EXISTS group_member_fts USING fts5(gid UNINDEXED, uid UNINDEXED, name, alias, alias_in_group, content = 'group_member', content_rowid = 'id', tokenize = '$tokenize');`,
+		triggers: []string{
+			`CREATE TRIGGER IF NOT EXISTS group_member_ai AFTER INSERT ON group_member BEGIN INSERT INTO group_member_fts(rowid, gid, uid, name, alias, alias_in_group) VALUES (new.id, new.gid, new.uid, new.name, new.alias, new.alias_in_group); END;`,
+			`CREATE TRIGGER IF NOT EXISTS group_member_ad AFTER DELETE ON group_member BEGIN INSERT INTO group_member_fts(group_member_fts, rowid, gid, uid, name, alias, alias_in_group) VALUES ('delete', old.id, old.gid, old.uid, old.name, old.alias, old.alias_in_group); END;`,
+			`CREATE TRIGGER IF NOT EXISTS group_member_au AFTER UPDATE ON group_member BEGIN INSERT INTO group_member_fts(group_member_fts, rowid, gid, uid, name, alias, alias_in_group) VALUES ('delete', old.id, old.gid, old.uid, old.name, old.alias, old.alias_in_group); INSERT INTO group_member_fts(rowid, gid, uid, name, alias, alias_in_group) VALUES (new.id, new.gid, new.uid, new.name, new.alias, new.alias_in_group); END;`,
+		},
+	},
+	{
+		idx: ftsIndex{table: "chat_message", columns: []string{"cid", "subject_id", "subject_type", "message", "sender_uid", "sent_at", "msg_type"}, key: []string{"cid"},
+			legacyDefaults: map[string]string{"message": "''", "sender_uid": "0", "sent_at": "0", "msg_type": "'text'"}},
+		create: []string{
+			`CREATE TABLE IF NOT EXISTS chat_message(cid INTEGER PRIMARY KEY, subject_id INTEGER NOT NULL, subject_type TEXT NOT NULL, message TEXT NOT NULL DEFAULT '', sender_uid INTEGER NOT NULL DEFAULT 0, sent_at INTEGER NOT NULL DEFAULT 0, msg_type TEXT NOT NULL DEFAULT 'text');`,
+			`CREATE INDEX IF NOT EXISTS idx_chat_message_subject ON chat_message(subject_type, subject_id, sent_at);`,
+		},
+		fts: `CREATE VIRTUAL TABLE IF NOT EXISTS chat_message_fts USING fts5(cid UNINDEXED, subject_id UNINDEXED, subject_type UNINDEXED, message, sender_uid UNINDEXED, sent_at UNINDEXED, msg_type UNINDEXED, content = 'chat_message', content_rowid = 'cid', tokenize = '$tokenize');`,
+		triggers: []string{
+			`CREATE TRIGGER IF NOT EXISTS chat_message_ai AFTER INSERT ON chat_message BEGIN INSERT INTO chat_message_fts(rowid, cid, subject_id, subject_type, message, sender_uid, sent_at, msg_type) VALUES (new.cid, new.cid, new.subject_id, new.subject_type, new.message, new.sender_uid, new.sent_at, new.msg_type); END;`,
+			`CREATE TRIGGER IF NOT EXISTS chat_message_ad AFTER DELETE ON chat_message BEGIN INSERT INTO chat_message_fts(chat_message_fts, rowid, cid, subject_id, subject_type, message, sender_uid, sent_at, msg_type) VALUES ('delete', old.cid, old.cid, old.subject_id, old.subject_type, old.message, old.sender_uid, old.sent_at, old.msg_type); END;`,
+			`CREATE TRIGGER IF NOT EXISTS chat_message_au AFTER UPDATE ON chat_message BEGIN INSERT INTO chat_message_fts(chat_message_fts, rowid, cid, subject_id, subject_type, message, sender_uid, sent_at, msg_type) VALUES ('delete', old.cid, old.cid, old.subject_id, old.subject_type, old.message, old.sender_uid, old.sent_at, old.msg_type); INSERT INTO chat_message_fts(rowid, cid, subject_id, subject_type, message, sender_uid, sent_at, msg_type) VALUES (new.cid, new.cid, new.subject_id, new.subject_type, new.message, new.sender_uid, new.sent_at, new.msg_type); END;`,
+		},
+	},
+	{
+		idx: ftsIndex{table: "contact", columns: []string{"uid", "name", "alias"}, key: []string{"uid"},
+			legacyDefaults: map[string]string{"name": "''", "alias": "''"}},
+		create: []string{
+			`CREATE TABLE IF NOT EXISTS contact(uid INTEGER PRIMARY KEY, name TEXT NOT NULL DEFAULT '', alias TEXT NOT NULL DEFAULT '');`,
+		},
+		fts: `CREATE VIRTUAL TABLE IF NOT EXISTS contact_fts USING fts5(uid UNINDEXED, name, alias, content = 'contact', content_rowid = 'uid', tokenize = '$tokenize');`,
+		triggers: []string{
+			`CREATE TRIGGER IF NOT EXISTS contact_ai AFTER INSERT ON contact BEGIN INSERT INTO contact_fts(rowid, uid, name, alias) VALUES (new.uid, new.uid, new.name, new.alias); END;`,
+			`CREATE TRIGGER IF NOT EXISTS contact_ad AFTER DELETE ON contact BEGIN INSERT INTO contact_fts(contact_fts, rowid, uid, name, alias) VALUES ('delete', old.uid, old.uid, old.name, old.alias); END;`,
+			`CREATE TRIGGER IF NOT EXISTS contact_au AFTER UPDATE ON contact BEGIN INSERT INTO contact_fts(contact_fts, rowid, uid, name, alias) VALUES ('delete', old.uid, old.uid, old.name, old.alias); INSERT INTO contact_fts(rowid, uid, name, alias) VALUES (new.uid, new.uid, new.name, new.alias); END;`,
+		},
+	},
+}
+
+// migrateV2 creates the trash table of SoftDelete.
+func migrateV2(ctx context.Context, tx *sql.Tx) error {
+	return createTrashTable(ctx, tx)
+}
@@ -0,0 +1,76 @@
+package im_search
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// schema returns the name and SQL of every object of db.
+func schema(t *testing.T, db *sql.DB) map[string]string {
+	t.Helper()
+	rows, err := db.Query(`SELECT name, coalesce(sql, '') FROM sqlite_master;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	objects := make(map[string]string)
+	for rows.Next() {
+		var name, stmt string
+		if err := rows.Scan(&name, &stmt); err != nil {
+			t.Fatal(err)
+		}
+		objects[name] = stmt
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return objects
+}
+
+func TestMigrateRollsBackFailedMigration(t *testing.T) {
+	db := openTestDB(t)
+	version, err := SchemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := schema(t, db)
+
+	failed := errors.New("step failed")
+	saved := Migrations
+	t.Cleanup(func() { Migrations = saved })
+	Migrations = append(append([]Migration(nil), saved...),
+		Migration{Version: version + 1, Name: "half done", Up: func(ctx context.Context, tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, `CREATE TABLE half_done(x INTEGER);`); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `ALTER TABLE contact ADD COLUMN half_done TEXT;`); err != nil {
+				return err
+			}
+			return failed
+		}},
+		Migration{Version: version + 2, Name: "never run", Up: func(ctx context.Context, tx *sql.Tx) error {
+			t.Error("migration after a failed one ran")
+			return nil
+		}},
+	)
+
+	applied, err := Migrate(db)
+	if !errors.Is(err, failed) {
+		t.Errorf("Migrate error = %v, want %v", err, failed)
+	}
+	if len(applied) != 0 {
+		t.Errorf("Migrate applied %v, want none", applied)
+	}
+	if v, err := SchemaVersion(db); err != nil || v != version {
+		t.Errorf("SchemaVersion = %d, %v, want %d", v, err, version)
+	}
+	if after := schema(t, db); !reflect.DeepEqual(after, before) {
+		t.Errorf("schema changed by a failed migration:\nbefore %v\nafter  %v", before, after)
+	}
+	if pending, err := PendingMigrations(db); err != nil || len(pending) != 2 {
+		t.Errorf("PendingMigrations = %d migrations, %v, want 2", len(pending), err)
+	}
+}
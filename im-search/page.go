@@ -0,0 +1,408 @@
+package im_search
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SortOrder selects how search hits are ordered.
+type SortOrder int
+
+const (
+	// DefaultOrder is ByRelevance for a search returning every hit at once. A search
+	// returning pages, with a Limit or a PageToken, gets a stable order instead: ByTime
+	// where the table supports it, ByRowid otherwise.
+	DefaultOrder SortOrder = iota
+	// ByRelevance orders hits by bm25 with column weights, best first. It is not stable
+	// across pages: bm25 scores change as rows are inserted, so hits can move between
+	// pages that were fetched at different times. Use it for a single page of top hits.
+	ByRelevance
+	// ByRowid orders hits by insertion order; pages are fully stable while rows are inserted.
+	ByRowid
+	// ByTime orders hits by time, newest first, with rowid breaking ties.
+	// Only tables listed in tableTimeColumn support it.
+	ByTime
+)
+
+// SearchOptions selects the order and the page of search hits.
+type SearchOptions struct {
+	Limit     int    // maximum hits per page; 0 returns every hit
+	Offset    int    // hits to skip; ignored when PageToken is set
+	PageToken string // NextPageToken of the previous page, continuing after its last hit
+	WithTotal bool   // also count every match into Page.Total
+	Order     SortOrder
+	// Weights sets the bm25 weight of columns by name; columns not listed fall back to
+	// DefaultColumnWeights for the table.
+	Weights map[string]float64
+	// Budget, when positive, limits the time the search may take. A search running out of
+	// it is interrupted and returns the hits found so far with Page.Truncated set, rather
+	// than an error.
+	Budget time.Duration
+}
+
+// Page is one page of search hits.
+type Page[T any] struct {
+	Hits          []T
+	Total         int    // number of matches, or -1 when SearchOptions.WithTotal was not set
+	NextPageToken string // empty on the last page
+	// Truncated is set when the search ran out of SearchOptions.Budget. Hits are then the
+	// first hits in order, NextPageToken continues after them when there are any, and
+	// Total is -1 unless counting finished.
+	Truncated bool
+}
+
+var (
+	ErrInvalidPageToken = errors.New("invalid page token")
+	ErrUnsupportedOrder = errors.New("sort order not supported for this search")
+)
+
+// registry guards tableColumns, tableTimeColumn and DefaultColumnWeights, which collections
+// loaded at run time write while searches read them. Read them through columnsOf,
+// timeColumnOf and defaultWeight.
+var registry sync.RWMutex
+
+// tableColumns lists the columns of every registered Collection in declaration order, which
+// is also the column order of its FTS5 index and the order bm25 expects its weights in.
+var tableColumns = map[string][]string{}
+
+// tableTimeColumn names the column ByTime orders each table by.
+var tableTimeColumn = map[string]string{}
+
+// DefaultColumnWeights are the bm25 weights used per table when a search sets none, taken
+// from Column.Weight when a Collection is registered. Columns not listed, such as ids,
+// weigh 0 and do not contribute to relevance. Change them only before searches run.
+var DefaultColumnWeights = map[string]map[string]float64{}
+
+// columnsOf returns the columns of the registered table in declaration order.
+func columnsOf(table string) []string {
+	registry.RLock()
+	defer registry.RUnlock()
+	return tableColumns[table]
+}
+
+// timeColumnOf returns the column ByTime orders table by, if any.
+func timeColumnOf(table string) (string, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	col, ok := tableTimeColumn[table]
+	return col, ok
+}
+
+// defaultWeight returns the DefaultColumnWeights of column col of table.
+func defaultWeight(table, col string) float64 {
+	registry.RLock()
+	defer registry.RUnlock()
+	return DefaultColumnWeights[table][col]
+}
+
+// isRegistered reports whether a collection registered table, compared as SQLite compares
+// names, ignoring case.
+func isRegistered(table string) bool {
+	registry.RLock()
+	defer registry.RUnlock()
+	return isRegisteredLocked(table)
+}
+
+func isRegisteredLocked(table string) bool {
+	for t := range tableColumns {
+		if strings.EqualFold(t, table) {
+			return true
+		}
+	}
+	return false
+}
+
+// pageKey is the position of a hit in the search order.
+type pageKey struct {
+	Rowid int64
+	Score float64 // raw bm25; lower is better
+	Time  int64   // value of the table's time column, set by scans of tables ordered ByTime
+}
+
+// searchQuery describes one paged search over an FTS5 table.
+type searchQuery struct {
+	op      string // name used in log lines
+	table   string
+	columns string // columns selected after rowid and score
+	// match is the full-text condition from columnMatch. Without it rows are listed by
+	// filter alone and every score is 0.
+	match      string
+	matchArgs  []any
+	filter     string // extra condition on the matched rows, may be empty
+	filterArgs []any
+}
+
+// from returns the table q reads: the FTS5 index of q.table when q has a match, the base
+// table otherwise. Both have the same columns, and the rowid of the index is the rowid of
+// the base table.
+func (q searchQuery) from() string {
+	if q.match != "" {
+		return ftsTable(q.table)
+	}
+	return q.table
+}
+
+// where returns the combined WHERE condition of q and its arguments.
+func (q searchQuery) where() (string, []any) {
+	var conds []string
+	var args []any
+	if q.match != "" {
+		conds = append(conds, q.match)
+		args = append(args, q.matchArgs...)
+	}
+	if q.filter != "" {
+		conds = append(conds, "("+q.filter+")")
+		args = append(args, q.filterArgs...)
+	}
+	if len(conds) == 0 {
+		return "1", nil
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// bm25Column returns "bm25(<table>_fts, ?, ...)" and the weights to bind for it.
+func bm25Column(table string, weights map[string]float64) (string, []any) {
+	columns := columnsOf(table)
+	marks := make([]string, len(columns))
+	args := make([]any, len(columns))
+	for i, col := range columns {
+		w, ok := weights[col]
+		if !ok {
+			w = defaultWeight(table, col)
+		}
+		marks[i] = "?"
+		args[i] = w
+	}
+	return "bm25(" + ftsTable(table) + ", " + strings.Join(marks, ", ") + ")", args
+}
+
+// searchPage runs "SELECT <columns> FROM <q.from()> WHERE <where>" for one page in opts.Order.
+// scan reads a row, storing the leading rowid and bm25 score columns into key, and the
+// time column too when the table supports ByTime.
+func searchPage[T any](ctx context.Context, db *sql.DB, q searchQuery, opts SearchOptions, scan func(rows *sql.Rows, key *pageKey) (T, error)) (Page[T], error) {
+	ctx, cancel := withBudget(ctx, opts.Budget)
+	defer cancel()
+	op, table := q.op, q.table
+	opts.Order = opts.resolvedOrder(table)
+	p := Page[T]{Total: -1}
+	after, err := decodePageToken(opts.PageToken, opts.Order)
+	if err != nil {
+		return p, opError(op, err)
+	}
+
+	bm25, queryArgs := "0", []any(nil)
+	if q.match != "" {
+		bm25, queryArgs = bm25Column(table, opts.Weights)
+	}
+	where, args := q.where()
+	queryArgs = append(queryArgs, args...)
+	sqlStmt := "SELECT * FROM (SELECT rowid AS rid, " + bm25 + " AS score, " + q.columns + " FROM " + q.from() + " WHERE " + where + ")"
+	keyset, orderBy, keysetArgs, err := pageOrder(table, opts.Order, after)
+	if err != nil {
+		return p, opError(op, err)
+	}
+	sqlStmt += " WHERE " + keyset + " ORDER BY " + orderBy
+	queryArgs = append(queryArgs, keysetArgs...)
+	limit, limitArgs := pageLimit(opts)
+	sqlStmt += limit
+	queryArgs = append(queryArgs, limitArgs...)
+
+	stmt, release, err := prepared(ctx, db, sqlStmt+";")
+	if err != nil {
+		p.Truncated = outOfBudget(ctx)
+		if p.Truncated {
+			return p, nil
+		}
+		return p, queryError(op, err)
+	}
+	defer release()
+	rows, err := stmt.QueryContext(ctx, queryArgs...)
+	if err != nil {
+		p.Truncated = outOfBudget(ctx)
+		if p.Truncated {
+			return p, nil
+		}
+		return p, queryError(op, err)
+	}
+	defer rows.Close()
+
+	var last pageKey
+	for rows.Next() {
+		if opts.Limit > 0 && len(p.Hits) == opts.Limit {
+			p.NextPageToken = encodePageToken(last, opts.Order)
+			break
+		}
+		var key pageKey
+		h, err := scan(rows, &key)
+		if err != nil {
+			return p, opError(op, err)
+		}
+		last = key
+		p.Hits = append(p.Hits, h)
+	}
+	if err := rows.Err(); err != nil {
+		p.Truncated = outOfBudget(ctx)
+		if !p.Truncated {
+			return p, queryError(op, err)
+		}
+		if len(p.Hits) > 0 {
+			p.NextPageToken = encodePageToken(last, opts.Order)
+		}
+		return p, nil
+	}
+	rows.Close()
+
+	if opts.WithTotal {
+		p.Total, err = countMatches(ctx, db, q.from(), where, args)
+		if err != nil {
+			p.Total = -1
+			p.Truncated = outOfBudget(ctx)
+			if !p.Truncated {
+				return p, queryError(op, err)
+			}
+		}
+	}
+	return p, nil
+}
+
+// errOutOfBudget is the cause of the context of a search that ran out of its budget.
+var errOutOfBudget = errors.New("search budget exhausted")
+
+// withBudget returns ctx limited to budget, or ctx itself when budget is not positive.
+func withBudget(ctx context.Context, budget time.Duration) (context.Context, context.CancelFunc) {
+	if budget <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeoutCause(ctx, budget, errOutOfBudget)
+}
+
+// outOfBudget reports whether ctx ended because the budget of the search, or of a search
+// it is part of, ran out, rather than being cancelled by the caller.
+func outOfBudget(ctx context.Context) bool {
+	return context.Cause(ctx) == errOutOfBudget
+}
+
+// mapPage converts the hits of p with f.
+func mapPage[T, H any](p Page[T], f func(T) H) Page[H] {
+	var hits []H
+	for _, h := range p.Hits {
+		hits = append(hits, f(h))
+	}
+	return Page[H]{Hits: hits, Total: p.Total, NextPageToken: p.NextPageToken, Truncated: p.Truncated}
+}
+
+// resolvedOrder returns the order opts selects for a search of table, resolving DefaultOrder.
+func (opts SearchOptions) resolvedOrder(table string) SortOrder {
+	switch {
+	case opts.Order != DefaultOrder:
+		return opts.Order
+	case opts.Limit <= 0 && opts.PageToken == "":
+		return ByRelevance
+	}
+	if _, ok := timeColumnOf(table); ok {
+		return ByTime
+	}
+	return ByRowid
+}
+
+// pageOrder returns the keyset condition selecting the hits after the position after, and
+// the ORDER BY terms of order. Both refer to the rid and score columns of a search and to
+// the table's time column.
+func pageOrder(table string, order SortOrder, after pageKey) (keyset, orderBy string, args []any, err error) {
+	switch order {
+	case ByRowid:
+		return "rid > ?", "rid", []any{after.Rowid}, nil
+	case ByTime:
+		col, ok := timeColumnOf(table)
+		if !ok {
+			return "", "", nil, ErrUnsupportedOrder
+		}
+		return "(" + col + ", rid) < (?, ?)", col + " DESC, rid DESC", []any{after.Time, after.Rowid}, nil
+	default:
+		return "(score, rid) > (?, ?)", "score, rid", []any{after.Score, after.Rowid}, nil
+	}
+}
+
+// pageLimit returns the LIMIT clause of opts and its arguments. It asks for one row more
+// than the limit, which tells whether there is a next page. Offset is ignored with a token.
+func pageLimit(opts SearchOptions) (string, []any) {
+	offset := opts.Offset
+	if opts.PageToken != "" {
+		offset = 0
+	}
+	if opts.Limit <= 0 && offset <= 0 {
+		return "", nil
+	}
+	limit := -1
+	if opts.Limit > 0 {
+		limit = opts.Limit + 1
+	}
+	return " LIMIT ? OFFSET ?", []any{limit, offset}
+}
+
+// countMatches counts the rows of table satisfying where.
+func countMatches(ctx context.Context, db *sql.DB, table, where string, args []any) (int, error) {
+	stmt, release, err := prepared(ctx, db, "SELECT count(*) FROM "+table+" WHERE "+where+";")
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	var n int
+	err = stmt.QueryRowContext(ctx, args...).Scan(&n)
+	return n, err
+}
+
+func encodePageToken(key pageKey, order SortOrder) string {
+	token := "rowid:" + strconv.FormatInt(key.Rowid, 10)
+	switch order {
+	case ByRelevance:
+		token = "rank:" + strconv.FormatFloat(key.Score, 'g', -1, 64) + ":" + strconv.FormatInt(key.Rowid, 10)
+	case ByTime:
+		token = "time:" + strconv.FormatInt(key.Time, 10) + ":" + strconv.FormatInt(key.Rowid, 10)
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(token))
+}
+
+// decodePageToken returns the position a page continues after; an empty token starts
+// before the first hit. A token issued for another order is invalid.
+func decodePageToken(token string, order SortOrder) (pageKey, error) {
+	if token == "" {
+		if order == ByTime {
+			return pageKey{Rowid: math.MaxInt64, Time: math.MaxInt64}, nil
+		}
+		return pageKey{Rowid: math.MinInt64, Score: math.Inf(-1)}, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return pageKey{}, ErrInvalidPageToken
+	}
+	parts := strings.Split(string(raw), ":")
+	var key pageKey
+	switch {
+	case order == ByRowid && len(parts) == 2 && parts[0] == "rowid":
+		key.Rowid, err = strconv.ParseInt(parts[1], 10, 64)
+	case order == ByRelevance && len(parts) == 3 && parts[0] == "rank":
+		key.Score, err = strconv.ParseFloat(parts[1], 64)
+		if err == nil {
+			key.Rowid, err = strconv.ParseInt(parts[2], 10, 64)
+		}
+	case order == ByTime && len(parts) == 3 && parts[0] == "time":
+		key.Time, err = strconv.ParseInt(parts[1], 10, 64)
+		if err == nil {
+			key.Rowid, err = strconv.ParseInt(parts[2], 10, 64)
+		}
+	default:
+		return pageKey{}, ErrInvalidPageToken
+	}
+	if err != nil {
+		return pageKey{}, ErrInvalidPageToken
+	}
+	return key, nil
+}
@@ -0,0 +1,41 @@
+package im_search
+
+import "testing"
+
+func TestDefaultOrderPagesStableAcrossInserts(t *testing.T) {
+	db := openTestDB(t)
+	for uid := 1; uid <= 5; uid++ {
+		if err := InsertContact(db, Contact{Uid: uid, Name: "alpha", Alias: "a"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := make(map[int]bool)
+	page := SearchOptions{Limit: 2}
+	for i := 0; ; i++ {
+		p, err := SearchContactPage(db, "alpha", DefaultHighlightOptions, page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, h := range p.Hits {
+			if seen[h.Uid] {
+				t.Fatalf("uid %d returned on two pages", h.Uid)
+			}
+			seen[h.Uid] = true
+		}
+		if p.NextPageToken == "" {
+			break
+		}
+		// Rows inserted between pages, which also change every bm25 score, must not
+		// reorder the hits still to come.
+		if err := InsertContact(db, Contact{Uid: 100 + i, Name: "alpha alpha alpha", Alias: "alpha"}); err != nil {
+			t.Fatal(err)
+		}
+		page.PageToken = p.NextPageToken
+	}
+	for uid := 1; uid <= 5; uid++ {
+		if !seen[uid] {
+			t.Errorf("uid %d missing from the pages", uid)
+		}
+	}
+}
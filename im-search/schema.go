@@ -0,0 +1,164 @@
+package im_search
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// ftsIndex describes the external-content FTS5 index kept over a base table. The index
+// declares every column of tableColumns so searches can select them, but it stores none:
+// FTS5 reads them back from the base table by rowid. Triggers keep it in sync.
+type ftsIndex struct {
+	table   string
+	columns []string // columns of table, columnsOf(table) when nil
+	rowid   string   // column of table used as the rowid of the index
+	key     []string // columns identifying a row of table
+	indexed []string // tokenized columns; the other columns are UNINDEXED
+	// tokenize is the FTS5 tokenize option, "simple 1" when empty.
+	tokenize string
+	// legacyDefaults are SQL values for columns missing from legacy tables being migrated.
+	legacyDefaults map[string]string
+}
+
+// ftsTokenize is the tokenize option of indexes that do not set one, and ftsHighlight the
+// function marking their matches. Both come from the simple extension; tests running where
+// it is not available switch to FTS5's unicode61 and highlight.
+var (
+	ftsTokenize  = "simple 1"
+	ftsHighlight = "simple_highlight"
+)
+
+// ftsTable returns the name of the FTS5 index of table.
+func ftsTable(table string) string {
+	return table + "_fts"
+}
+
+// createIndexedTable runs the CREATE statements of a base table in tx, then creates its
+// FTS5 index, triggers and vocabulary. A legacy table, which was a standalone FTS5 table
+// under the same name, is migrated: its rows are copied into the new base table, keeping
+// the last row inserted for each key, and it is dropped along with its fts5vocab table.
+func createIndexedTable(ctx context.Context, tx *sql.Tx, idx ftsIndex, create ...string) error {
+	return convertTable(ctx, tx, idx, append(create, idx.statements()...))
+}
+
+// convertTable runs stmts, which create the base table of idx and its index, in tx,
+// migrating a legacy table like createIndexedTable.
+func convertTable(ctx context.Context, tx *sql.Tx, idx ftsIndex, stmts []string) error {
+	legacy, err := isVirtualTable(ctx, tx, idx.table)
+	if err != nil {
+		return err
+	}
+	old := idx.table + "_v1"
+	if legacy {
+		stmts = append([]string{
+			`ALTER TABLE ` + idx.table + ` RENAME TO ` + old + `;`,
+			`DROP TABLE IF EXISTS ` + idx.table + `_vocab;`,
+		}, stmts...)
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	if !legacy {
+		return nil
+	}
+	copySQL, err := idx.copyLegacy(ctx, tx, old)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, copySQL); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DROP TABLE `+old+`;`)
+	return err
+}
+
+// statements returns the statements creating the index, its triggers and its fts5vocab table.
+func (idx ftsIndex) statements() []string {
+	t, fts := idx.table, ftsTable(idx.table)
+	columns := idx.columnNames()
+	decl := make([]string, len(columns))
+	newVals := []string{"new." + idx.rowid}
+	oldVals := []string{"old." + idx.rowid}
+	for i, col := range columns {
+		decl[i] = col + " UNINDEXED"
+		for _, c := range idx.indexed {
+			if c == col {
+				decl[i] = col
+			}
+		}
+		newVals = append(newVals, "new."+col)
+		oldVals = append(oldVals, "old."+col)
+	}
+	tokenize := idx.tokenize
+	if tokenize == "" {
+		tokenize = ftsTokenize
+	}
+	cols := strings.Join(columns, ", ")
+	insert := `INSERT INTO ` + fts + `(rowid, ` + cols + `) VALUES (` + strings.Join(newVals, ", ") + `);`
+	remove := `INSERT INTO ` + fts + `(` + fts + `, rowid, ` + cols + `) VALUES ('delete', ` + strings.Join(oldVals, ", ") + `);`
+	return []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS ` + fts + ` USING fts5(` + strings.Join(decl, ", ") + `, content = '` + t + `', content_rowid = '` + idx.rowid + `', tokenize = '` + tokenize + `');`,
+		`CREATE TRIGGER IF NOT EXISTS ` + t + `_ai AFTER INSERT ON ` + t + ` BEGIN ` + insert + ` END;`,
+		`CREATE TRIGGER IF NOT EXISTS ` + t + `_ad AFTER DELETE ON ` + t + ` BEGIN ` + remove + ` END;`,
+		`CREATE TRIGGER IF NOT EXISTS ` + t + `_au AFTER UPDATE ON ` + t + ` BEGIN ` + remove + ` ` + insert + ` END;`,
+		`CREATE VIRTUAL TABLE IF NOT EXISTS ` + t + `_vocab USING fts5vocab(` + fts + `, 'row');`,
+	}
+}
+
+func (idx ftsIndex) columnNames() []string {
+	if idx.columns != nil {
+		return idx.columns
+	}
+	return columnsOf(idx.table)
+}
+
+// copyLegacy returns the statement copying the rows of the legacy table old into the base table.
+func (idx ftsIndex) copyLegacy(ctx context.Context, tx *sql.Tx, old string) (string, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT name FROM pragma_table_info(?);`, old)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	present := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return "", err
+		}
+		present[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	columns := idx.columnNames()
+	values := make([]string, len(columns))
+	for i, col := range columns {
+		values[i] = col
+		if !present[col] {
+			values[i] = idx.legacyDefaults[col]
+		}
+	}
+	key := make([]string, len(idx.key))
+	for i, col := range idx.key {
+		key[i] = "CAST(" + col + " AS INTEGER)"
+	}
+	return `INSERT INTO ` + idx.table + `(` + strings.Join(columns, ", ") + `) SELECT ` + strings.Join(values, ", ") +
+		` FROM ` + old + ` WHERE rowid IN (SELECT max(rowid) FROM ` + old + ` GROUP BY ` + strings.Join(key, ", ") + `);`, nil
+}
+
+// isVirtualTable reports whether table exists and is a virtual table.
+func isVirtualTable(ctx context.Context, tx *sql.Tx, table string) (bool, error) {
+	var createSQL string
+	err := tx.QueryRowContext(ctx, `SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?;`, table).Scan(&createSQL)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return strings.HasPrefix(strings.ToUpper(createSQL), "CREATE VIRTUAL TABLE"), nil
+}
@@ -0,0 +1,145 @@
+package im_search
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/chrwhy/simple/examples/go/qparser"
+)
+
+// DefaultCategoryLimit is the number of hits SearchAll keeps per category when no limit is set.
+const DefaultCategoryLimit = 20
+
+// SearchAllOptions sets per-category hit limits and how matches are highlighted.
+// A zero limit means DefaultCategoryLimit.
+type SearchAllOptions struct {
+	ContactLimit     int
+	ChatGroupLimit   int
+	GroupMemberLimit int
+	ChatMessageLimit int
+	Highlight        HighlightOptions
+	// ViewerUid, when non-zero, restricts chat messages to the conversations ViewerUid
+	// belongs to (see MessageFilter.ViewerUid).
+	ViewerUid int
+	// Budget, when positive, limits the time of the whole search, see SearchOptions.Budget.
+	// Categories that run out of it are returned with Truncated set.
+	Budget time.Duration
+}
+
+// Category is the result of one category search within SearchAll.
+type Category[T any] struct {
+	Hits  []T
+	Total int           // number of matches before the limit was applied, -1 if unknown or not searched
+	Took  time.Duration // time spent in this category's search
+	// Truncated is set when the search ran out of SearchAllOptions.Budget; Hits are then
+	// the hits found in time.
+	Truncated bool
+	Err       error
+}
+
+// SearchAllResult groups the hits of every category for one query.
+type SearchAllResult struct {
+	Query        string
+	Clause       string // FTS5 clause parsed from the keywords of Query and used for every category
+	Contacts     Category[ContactHit]
+	ChatGroups   Category[ChatGroupHit]
+	GroupMembers Category[GroupMemberHit]
+	ChatMessages Category[ChatMessageHit]
+	Took         time.Duration
+}
+
+// SearchAll parses query once with qparser.ParseClause and searches contacts, chat groups,
+// group members and chat messages in parallel with the same clause.
+// Operators in query (see SearchChatMessagesQuery) only filter chat messages; a query made
+// of operators alone lists the matching messages, newest first, and does not search
+// entities.
+// A failing category does not stop the others; its error is kept in the category and
+// all category errors are joined into the returned error.
+func SearchAll(db *sql.DB, query string, opts SearchAllOptions) (SearchAllResult, error) {
+	return SearchAllContext(context.Background(), db, query, opts)
+}
+
+// SearchAllContext is SearchAll with a context.
+func SearchAllContext(ctx context.Context, db *sql.DB, query string, opts SearchAllOptions) (SearchAllResult, error) {
+	t0 := time.Now()
+	ctx, cancel := withBudget(ctx, opts.Budget)
+	defer cancel()
+	res := SearchAllResult{Query: query}
+	res.Contacts.Total, res.ChatGroups.Total, res.GroupMembers.Total, res.ChatMessages.Total = -1, -1, -1, -1
+	ops, rest, err := qparser.ParseOperators(query)
+	if err != nil {
+		return res, invalidQuery("SearchAll", err)
+	}
+	res.Clause = parseClause(rest)
+	if res.Clause == "" && ops.IsZero() {
+		return res, nil
+	}
+	filter, ok, err := ResolveMessageFilterContext(ctx, db, ops)
+	// Messages can't be filtered once the budget ran out resolving the operators.
+	resolveTruncated := err != nil && outOfBudget(ctx)
+	if resolveTruncated {
+		ok, err = false, nil
+	}
+	if err != nil {
+		return res, err
+	}
+	filter.ViewerUid = opts.ViewerUid
+	if opts.Highlight.PinyinQuery == "" {
+		opts.Highlight.PinyinQuery = rest
+	}
+	entities := res.Clause != ""
+	messageOrder := ByRelevance
+	if !entities {
+		messageOrder = ByTime
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		res.Contacts = runCategory(entities, opts.ContactLimit, func(page SearchOptions) (Page[ContactHit], error) {
+			return SearchContactPageContext(ctx, db, res.Clause, opts.Highlight, page)
+		})
+	}()
+	go func() {
+		defer wg.Done()
+		res.ChatGroups = runCategory(entities, opts.ChatGroupLimit, func(page SearchOptions) (Page[ChatGroupHit], error) {
+			return SearchChatGroupPageContext(ctx, db, res.Clause, opts.Highlight, page)
+		})
+	}()
+	go func() {
+		defer wg.Done()
+		res.GroupMembers = runCategory(entities, opts.GroupMemberLimit, func(page SearchOptions) (Page[GroupMemberHit], error) {
+			return SearchGroupMemberPageContext(ctx, db, res.Clause, opts.Highlight, page)
+		})
+	}()
+	go func() {
+		defer wg.Done()
+		res.ChatMessages = runCategory(ok, opts.ChatMessageLimit, func(page SearchOptions) (Page[ChatMessageHit], error) {
+			page.Order = messageOrder
+			return searchChatMessagePage(ctx, db, res.Clause, filter, opts.Highlight, page)
+		})
+	}()
+	wg.Wait()
+	res.ChatMessages.Truncated = res.ChatMessages.Truncated || resolveTruncated
+
+	res.Took = time.Since(t0)
+	return res, errors.Join(res.Contacts.Err, res.ChatGroups.Err, res.GroupMembers.Err, res.ChatMessages.Err)
+}
+
+// runCategory times search and asks it for the first limit hits and the total match count.
+// A category that should not run reports no hits and a Total of -1.
+func runCategory[T any](run bool, limit int, search func(page SearchOptions) (Page[T], error)) Category[T] {
+	if !run {
+		return Category[T]{Total: -1}
+	}
+	if limit <= 0 {
+		limit = DefaultCategoryLimit
+	}
+	t0 := time.Now()
+	p, err := search(SearchOptions{Limit: limit, WithTotal: true, Order: ByRelevance})
+	return Category[T]{Hits: p.Hits, Total: p.Total, Took: time.Since(t0), Truncated: p.Truncated, Err: err}
+}
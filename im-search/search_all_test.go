@@ -0,0 +1,33 @@
+package im_search
+
+import "testing"
+
+func TestSearchAllTotals(t *testing.T) {
+	db := seedConversations(t)
+	tests := []struct {
+		query string
+		// want holds the Total of contacts, chat groups, group members and chat messages.
+		want [4]int
+	}{
+		{query: "", want: [4]int{-1, -1, -1, -1}},
+		{query: "review", want: [4]int{0, 0, 0, 4}},
+		{query: "alice", want: [4]int{1, 0, 0, 0}},
+		{query: "in:dev", want: [4]int{-1, -1, -1, 4}},
+		{query: "from:nobody", want: [4]int{-1, -1, -1, -1}},
+		{query: "in:dev review", want: [4]int{0, 0, 0, 3}},
+	}
+	for _, tt := range tests {
+		res, err := SearchAll(db, tt.query, SearchAllOptions{})
+		if err != nil {
+			t.Errorf("SearchAll(%q) error = %v", tt.query, err)
+			continue
+		}
+		got := [4]int{res.Contacts.Total, res.ChatGroups.Total, res.GroupMembers.Total, res.ChatMessages.Total}
+		if got != tt.want {
+			t.Errorf("SearchAll(%q) totals = %v, want %v", tt.query, got, tt.want)
+		}
+		if n := len(res.ChatMessages.Hits); tt.want[3] >= 0 && n != tt.want[3] {
+			t.Errorf("SearchAll(%q) returned %d messages, want %d", tt.query, n, tt.want[3])
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package im_search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSeedTwice(t *testing.T) {
+	db := openTestDB(t)
+	tables := []string{"chat_group", "group_member", "contact", "chat_message"}
+	counts := func() map[string]int {
+		counts := make(map[string]int)
+		for _, table := range tables {
+			for _, name := range []string{table, ftsTable(table)} {
+				var n int
+				if err := db.QueryRow(`SELECT count(*) FROM ` + name + `;`).Scan(&n); err != nil {
+					t.Fatalf("count %s: %v", name, err)
+				}
+				counts[name] = n
+			}
+			fts := ftsTable(table)
+			if _, err := db.Exec(`INSERT INTO ` + fts + `(` + fts + `) VALUES ('integrity-check');`); err != nil {
+				t.Errorf("%s integrity-check: %v", fts, err)
+			}
+		}
+		return counts
+	}
+
+	seed(t, db)
+	first := counts()
+	for _, table := range tables {
+		if first[table] == 0 {
+			t.Errorf("seed left %s empty", table)
+		}
+	}
+	seed(t, db)
+	if second := counts(); !reflect.DeepEqual(second, first) {
+		t.Errorf("row counts after seeding twice = %v, want %v", second, first)
+	}
+}
@@ -0,0 +1,130 @@
+package im_search
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"unicode"
+)
+
+// SnippetOptions controls the excerpts built around matches in long messages.
+type SnippetOptions struct {
+	// Tokens is the number of tokens kept on each side of a match. A hanzi, a run of
+	// letters or digits, and any other non-space character each count as one token.
+	Tokens int
+	// Ellipsis is put between fragments and where text was cut at either end.
+	Ellipsis string
+	// MaxFragments caps the number of fragments; earlier fragments are kept.
+	MaxFragments int
+	Highlight    HighlightOptions
+}
+
+// DefaultSnippetOptions fits a search result list line.
+var DefaultSnippetOptions = SnippetOptions{
+	Tokens:       8,
+	Ellipsis:     "...",
+	MaxFragments: 2,
+	Highlight:    DefaultHighlightOptions,
+}
+
+// SearchChatMessageSnippets is like SearchChatMessageHits but also sets Snippet on every hit
+// to an excerpt of the message around its matches.
+func SearchChatMessageSnippets(db *sql.DB, q string, opts SnippetOptions) ([]ChatMessageHit, error) {
+	return SearchChatMessageSnippetsContext(context.Background(), db, q, opts)
+}
+
+// SearchChatMessageSnippetsContext is SearchChatMessageSnippets with a context.
+func SearchChatMessageSnippetsContext(ctx context.Context, db *sql.DB, q string, opts SnippetOptions) ([]ChatMessageHit, error) {
+	hits, err := SearchChatMessageHitsContext(ctx, db, q, opts.Highlight)
+	for i := range hits {
+		hits[i].Snippet = Snippet(hits[i].Message, hits[i].Spans["message"], opts)
+	}
+	return hits, err
+}
+
+// Snippet returns up to opts.MaxFragments excerpts of raw around spans, each keeping
+// opts.Tokens tokens of context, with matches rendered using opts.Highlight.
+func Snippet(raw string, spans []Span, opts SnippetOptions) string {
+	runes := []rune(raw)
+	tokens := tokenize(runes)
+	if len(tokens) == 0 {
+		return ""
+	}
+
+	// Fragments are ranges of token indexes, merged when they touch.
+	type fragment struct{ first, last int }
+	var fragments []fragment
+	if len(spans) == 0 {
+		fragments = append(fragments, fragment{0, min(len(tokens)-1, 2*opts.Tokens)})
+	}
+	for _, s := range spans {
+		first := tokenAt(tokens, s.Start)
+		last := tokenAt(tokens, s.Start+s.Length-1)
+		f := fragment{max(0, first-opts.Tokens), min(len(tokens)-1, last+opts.Tokens)}
+		if n := len(fragments); n > 0 && f.first <= fragments[n-1].last+1 {
+			fragments[n-1].last = max(fragments[n-1].last, f.last)
+			continue
+		}
+		fragments = append(fragments, f)
+	}
+	if opts.MaxFragments > 0 && len(fragments) > opts.MaxFragments {
+		fragments = fragments[:opts.MaxFragments]
+	}
+
+	var b strings.Builder
+	for i, f := range fragments {
+		start, end := tokens[f.first][0], tokens[f.last][1]
+		// Leading whitespace belongs to no token, so the text was cut only before the first one.
+		if i > 0 || start > tokens[0][0] {
+			b.WriteString(opts.Ellipsis)
+		}
+		var local []Span
+		for _, s := range spans {
+			if s.Start >= start && s.Start+s.Length <= end {
+				local = append(local, Span{Start: s.Start - start, Length: s.Length})
+			}
+		}
+		b.WriteString(RenderHighlight(string(runes[start:end]), local, opts.Highlight))
+		if i == len(fragments)-1 && end < len(runes) {
+			b.WriteString(opts.Ellipsis)
+		}
+	}
+	return b.String()
+}
+
+// tokenize splits runes into [start, end) ranges of tokens, with any whitespace
+// following a token kept inside it so fragments render with their spacing.
+func tokenize(runes []rune) [][2]int {
+	var tokens [][2]int
+	for i := 0; i < len(runes); {
+		start := i
+		switch r := runes[i]; {
+		case unicode.IsSpace(r):
+			if len(tokens) > 0 {
+				tokens[len(tokens)-1][1]++
+			}
+			i++
+			continue
+		case unicode.Is(unicode.Han, r):
+			i++
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) && !unicode.Is(unicode.Han, runes[i]) {
+				i++
+			}
+		default:
+			i++
+		}
+		tokens = append(tokens, [2]int{start, i})
+	}
+	return tokens
+}
+
+// tokenAt returns the index of the token containing rune offset pos.
+func tokenAt(tokens [][2]int, pos int) int {
+	for i, t := range tokens {
+		if pos < t[1] {
+			return i
+		}
+	}
+	return len(tokens) - 1
+}
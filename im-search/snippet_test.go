@@ -0,0 +1,30 @@
+package im_search
+
+import "testing"
+
+func TestSnippet(t *testing.T) {
+	opts := SnippetOptions{Tokens: 1, Ellipsis: "...", MaxFragments: 2, Highlight: DefaultHighlightOptions}
+	tests := []struct {
+		raw   string
+		spans []Span
+		opts  SnippetOptions
+		want  string
+	}{
+		{raw: "hello world", spans: []Span{{Start: 0, Length: 5}}, opts: opts, want: "[hello] world"},
+		{raw: "  hello world", spans: []Span{{Start: 2, Length: 5}}, opts: opts, want: "[hello] world"},
+		{raw: "hello world  ", spans: []Span{{Start: 6, Length: 5}}, opts: opts, want: "hello [world]  "},
+		{raw: "one two three four five", spans: []Span{{Start: 8, Length: 5}}, opts: opts, want: "...two [three] four ..."},
+		{raw: "  one two three", spans: []Span{{Start: 10, Length: 5}}, opts: opts, want: "...two [three]"},
+		{raw: "a b c d e f g h", spans: []Span{{Start: 0, Length: 1}, {Start: 8, Length: 1}, {Start: 14, Length: 1}}, opts: opts, want: "[a] b ...d [e] f g [h]"},
+		{raw: "a b c d e f g h i j", spans: []Span{{Start: 0, Length: 1}, {Start: 8, Length: 1}, {Start: 16, Length: 1}}, opts: opts, want: "[a] b ...d [e] f ..."},
+		{raw: "a b c d e f g h i j", spans: []Span{{Start: 0, Length: 1}, {Start: 8, Length: 1}, {Start: 16, Length: 1}}, opts: SnippetOptions{Tokens: 1, Ellipsis: "…"}, want: "a b …d e f …h i j"},
+		{raw: "我们今天开会", spans: []Span{{Start: 2, Length: 2}}, opts: opts, want: "...们[今天]开..."},
+		{raw: "one two three four", opts: opts, want: "one two three ..."},
+		{raw: "   ", opts: opts, want: ""},
+	}
+	for _, tt := range tests {
+		if got := Snippet(tt.raw, tt.spans, tt.opts); got != tt.want {
+			t.Errorf("Snippet(%q, %v) = %q, want %q", tt.raw, tt.spans, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package im_search
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/chrwhy/simple/examples/go/qparser"
+)
+
+// TypoOptions controls how misspelled English query terms are expanded.
+type TypoOptions struct {
+	// MaxDistance is the maximum edit distance between a query term and an indexed term.
+	MaxDistance int
+	// MaxExpansions caps how many indexed terms a single query term expands into.
+	// Candidates with the highest document frequency are kept.
+	MaxExpansions int
+	// MinDocFreq ignores indexed terms that appear in fewer documents than this.
+	MinDocFreq int
+	// Penalty is subtracted from the bm25 relevance for every edit needed to reach a matched term.
+	Penalty float64
+}
+
+// DefaultTypoOptions tolerates up to two edits per term and keeps the five most common corrections.
+var DefaultTypoOptions = TypoOptions{
+	MaxDistance:   2,
+	MaxExpansions: 5,
+	MinDocFreq:    1,
+	Penalty:       1.0,
+}
+
+// TermCandidate is an indexed term that a query term may have been meant to be.
+type TermCandidate struct {
+	Term     string
+	Distance int
+	DocFreq  int
+}
+
+// FuzzyChatGroup is a chat group found by SearchChatGroupsTypo. Its Score is the weighted
+// bm25 relevance minus the correction penalty; higher is better.
+type FuzzyChatGroup struct {
+	ChatGroupHit
+	Corrections int // edits needed to reach the matched terms
+}
+
+// FuzzyGroupMember is a group member found by SearchGroupMembersTypo, scored like
+// FuzzyChatGroup.
+type FuzzyGroupMember struct {
+	GroupMemberHit
+	Corrections int // edits needed to reach the matched terms
+}
+
+// CreateVocabTable creates an fts5vocab table named <table>_vocab over the FTS5 index of
+// table, a registered collection. Tables created by Migrate or a Create function already
+// have one.
+func CreateVocabTable(db *sql.DB, table string) error {
+	return CreateVocabTableContext(context.Background(), db, table)
+}
+
+// CreateVocabTableContext is CreateVocabTable with a context.
+func CreateVocabTableContext(ctx context.Context, db *sql.DB, table string) error {
+	return opError("CreateVocabTable", createVocabTable(ctx, db, table))
+}
+
+func createVocabTable(ctx context.Context, db dbtx, table string) error {
+	if err := checkTable(table); err != nil {
+		return err
+	}
+	createSQL := `CREATE VIRTUAL TABLE IF NOT EXISTS ` + table + `_vocab USING fts5vocab(` + ftsTable(table) + `, 'row');`
+	_, err := db.ExecContext(ctx, createSQL)
+	return err
+}
+
+// CreateVocabTables creates the vocabulary tables for every im_search table.
+func CreateVocabTables(db *sql.DB) error {
+	return CreateVocabTablesContext(context.Background(), db)
+}
+
+// CreateVocabTablesContext is CreateVocabTables with a context.
+func CreateVocabTablesContext(ctx context.Context, db *sql.DB) error {
+	for _, table := range []string{"chat_group", "group_member", "contact", "chat_message"} {
+		if err := CreateVocabTableContext(ctx, db, table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTable fails unless table is the table of a registered collection, as its name is
+// put into SQL unquoted.
+func checkTable(table string) error {
+	if !isRegistered(table) {
+		return fmt.Errorf("table %q is not a registered collection", table)
+	}
+	return nil
+}
+
+// ExpandTerm returns the indexed terms of table, a registered collection, within opts.MaxDistance edits of term,
+// ordered by distance and then by descending document frequency.
+// The exact term is included with distance 0 when it is indexed.
+func ExpandTerm(db *sql.DB, table, term string, opts TypoOptions) ([]TermCandidate, error) {
+	return ExpandTermContext(context.Background(), db, table, term, opts)
+}
+
+// ExpandTermContext is ExpandTerm with a context.
+func ExpandTermContext(ctx context.Context, db *sql.DB, table, term string, opts TypoOptions) ([]TermCandidate, error) {
+	if err := checkTable(table); err != nil {
+		return nil, invalidQuery("ExpandTerm", err)
+	}
+	term = strings.ToLower(term)
+	n := len([]rune(term))
+	query := `SELECT term, doc FROM ` + table + `_vocab WHERE length(term) BETWEEN ? AND ? AND doc >= ?;`
+	rows, err := db.QueryContext(ctx, query, n-opts.MaxDistance, n+opts.MaxDistance, opts.MinDocFreq)
+	if err != nil {
+		return nil, opError("ExpandTerm", err)
+	}
+	defer rows.Close()
+
+	var candidates []TermCandidate
+	for rows.Next() {
+		var c TermCandidate
+		if err := rows.Scan(&c.Term, &c.DocFreq); err != nil {
+			return nil, opError("ExpandTerm", err)
+		}
+		if !qparser.IsAllEn(c.Term) {
+			continue
+		}
+		c.Distance = editDistance(term, c.Term)
+		if c.Distance <= opts.MaxDistance {
+			candidates = append(candidates, c)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return candidates, opError("ExpandTerm", err)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Distance != candidates[j].Distance {
+			return candidates[i].Distance < candidates[j].Distance
+		}
+		return candidates[i].DocFreq > candidates[j].DocFreq
+	})
+	if opts.MaxExpansions > 0 && len(candidates) > opts.MaxExpansions {
+		candidates = candidates[:opts.MaxExpansions]
+	}
+	return candidates, nil
+}
+
+// TypoClause builds an FTS5 clause like qparser.ParseClause, but every English token is
+// OR-ed with the indexed terms of table it may be a misspelling of.
+// The returned map holds the edit distance of every expanded term and is used for ranking.
+func TypoClause(db *sql.DB, table, query string, opts TypoOptions) (string, map[string]int, error) {
+	return TypoClauseContext(context.Background(), db, table, query, opts)
+}
+
+// TypoClauseContext is TypoClause with a context.
+func TypoClauseContext(ctx context.Context, db *sql.DB, table, query string, opts TypoOptions) (string, map[string]int, error) {
+	clause := ""
+	distances := make(map[string]int)
+	for _, token := range strings.Fields(query) {
+		partial := qparser.ParseClause(token)
+		if qparser.IsAllEn(token) {
+			candidates, err := ExpandTermContext(ctx, db, table, token, opts)
+			if err != nil {
+				return "", nil, err
+			}
+			alternatives := []string{partial}
+			for _, c := range candidates {
+				distances[c.Term] = c.Distance
+				if c.Distance > 0 {
+					alternatives = append(alternatives, `"`+c.Term+`"`)
+				}
+			}
+			partial = "(" + strings.Join(alternatives, " OR ") + ")"
+		}
+		if len(clause) > 0 {
+			clause += " AND "
+		}
+		clause += partial
+	}
+	return clause, distances, nil
+}
+
+// SearchChatGroupsTypo searches chat groups by name and alias, tolerating misspelled English terms,
+// and reports their raw values with matched spans rendered by hl. Results are ordered by weighted
+// bm25 relevance minus opts.Penalty for every correction that was needed.
+func SearchChatGroupsTypo(db *sql.DB, query string, opts TypoOptions, hl HighlightOptions) ([]FuzzyChatGroup, error) {
+	return SearchChatGroupsTypoContext(context.Background(), db, query, opts, hl)
+}
+
+// SearchChatGroupsTypoContext is SearchChatGroupsTypo with a context.
+func SearchChatGroupsTypoContext(ctx context.Context, db *sql.DB, query string, opts TypoOptions, hl HighlightOptions) ([]FuzzyChatGroup, error) {
+	clause, distances, err := TypoClauseContext(ctx, db, "chat_group", query, opts)
+	if err != nil || clause == "" {
+		return nil, err
+	}
+	bm25, args := bm25Column("chat_group", nil)
+	where, matchArgs := columnMatch("chat_group", []string{"name", "alias"}, clause)
+	sqlStmt := `SELECT gid, name, alias, ` + highlightColumn("chat_group", 1) + `, ` + highlightColumn("chat_group", 2) + `, ` + bm25 + ` FROM chat_group_fts WHERE ` + where + `;`
+	rows, err := db.QueryContext(ctx, sqlStmt, append(args, matchArgs...)...)
+	if err != nil {
+		return nil, queryError("SearchChatGroupsTypo", err)
+	}
+	defer rows.Close()
+
+	var results []FuzzyChatGroup
+	for rows.Next() {
+		var g FuzzyChatGroup
+		marked := make([]string, 2)
+		var rank float64
+		if err := rows.Scan(&g.Gid, &g.Name, &g.Alias, &marked[0], &marked[1], &rank); err != nil {
+			return nil, opError("SearchChatGroupsTypo", err)
+		}
+		columns, raw := []string{"name", "alias"}, []string{g.Name, g.Alias}
+		g.Spans, g.Highlighted = highlightFields(columns, map[string]bool{"name": true}, raw, marked, hl)
+		g.Corrections = corrections(distances, columns, raw, g.Spans)
+		g.Score = -rank - opts.Penalty*float64(g.Corrections)
+		results = append(results, g)
+	}
+	if err := rows.Err(); err != nil {
+		return results, queryError("SearchChatGroupsTypo", err)
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	return results, nil
+}
+
+// SearchGroupMembersTypo searches group members by name, alias and alias_in_group,
+// tolerating misspelled English terms, like SearchChatGroupsTypo.
+func SearchGroupMembersTypo(db *sql.DB, query string, opts TypoOptions, hl HighlightOptions) ([]FuzzyGroupMember, error) {
+	return SearchGroupMembersTypoContext(context.Background(), db, query, opts, hl)
+}
+
+// SearchGroupMembersTypoContext is SearchGroupMembersTypo with a context.
+func SearchGroupMembersTypoContext(ctx context.Context, db *sql.DB, query string, opts TypoOptions, hl HighlightOptions) ([]FuzzyGroupMember, error) {
+	clause, distances, err := TypoClauseContext(ctx, db, "group_member", query, opts)
+	if err != nil || clause == "" {
+		return nil, err
+	}
+	bm25, args := bm25Column("group_member", nil)
+	where, matchArgs := columnMatch("group_member", []string{"name", "alias", "alias_in_group"}, clause)
+	sqlStmt := `SELECT gid, uid, name, alias, alias_in_group, ` + highlightColumn("group_member", 2) + `, ` + highlightColumn("group_member", 3) + `, ` + highlightColumn("group_member", 4) + `, ` + bm25 + ` FROM group_member_fts WHERE ` + where + `;`
+	rows, err := db.QueryContext(ctx, sqlStmt, append(args, matchArgs...)...)
+	if err != nil {
+		return nil, queryError("SearchGroupMembersTypo", err)
+	}
+	defer rows.Close()
+
+	var results []FuzzyGroupMember
+	for rows.Next() {
+		var gm FuzzyGroupMember
+		marked := make([]string, 3)
+		var rank float64
+		if err := rows.Scan(&gm.Gid, &gm.Uid, &gm.Name, &gm.Alias, &gm.AliasInGroup, &marked[0], &marked[1], &marked[2], &rank); err != nil {
+			return nil, opError("SearchGroupMembersTypo", err)
+		}
+		columns, raw := []string{"name", "alias", "alias_in_group"}, []string{gm.Name, gm.Alias, gm.AliasInGroup}
+		gm.Spans, gm.Highlighted = highlightFields(columns, map[string]bool{"name": true}, raw, marked, hl)
+		gm.Corrections = corrections(distances, columns, raw, gm.Spans)
+		gm.Score = -rank - opts.Penalty*float64(gm.Corrections)
+		results = append(results, gm)
+	}
+	if err := rows.Err(); err != nil {
+		return results, queryError("SearchGroupMembersTypo", err)
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	return results, nil
+}
+
+// corrections sums the edit distances of the expanded terms at the spans of the raw values
+// of columns.
+func corrections(distances map[string]int, columns, raw []string, spans map[string][]Span) int {
+	total := 0
+	seen := make(map[string]bool)
+	for i, col := range columns {
+		runes := []rune(raw[i])
+		for _, sp := range spans[col] {
+			term := strings.ToLower(string(runes[sp.Start : sp.Start+sp.Length]))
+			if d, ok := distances[term]; ok && !seen[term] {
+				seen[term] = true
+				total += d
+			}
+		}
+	}
+	return total
+}
+
+// editDistance returns the Levenshtein distance between a and b, counted in runes.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
@@ -0,0 +1,67 @@
+package im_search
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSearchChatGroupsTypoBracketedNames(t *testing.T) {
+	db := openTestDB(t)
+	// The brackets of the name must not be taken for highlights: both words are
+	// corrections of the query, releas by two edits and release by one.
+	if err := InsertChatGroup(db, ChatGroup{Gid: 1, Name: "[releas] release", Alias: "[x]"}); err != nil {
+		t.Fatal(err)
+	}
+	groups, err := SearchChatGroupsTypo(db, "relase", DefaultTypoOptions, HighlightOptions{Open: "<b>", Close: "</b>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 {
+		t.Fatalf("SearchChatGroupsTypo = %+v, want gid 1", groups)
+	}
+	g := groups[0]
+	if want := (ChatGroup{Gid: 1, Name: "[releas] release", Alias: "[x]"}); g.ChatGroup != want {
+		t.Errorf("ChatGroup = %+v, want the raw values %+v", g.ChatGroup, want)
+	}
+	if want := []Span{{Start: 1, Length: 6}, {Start: 9, Length: 7}}; !reflect.DeepEqual(g.Spans["name"], want) {
+		t.Errorf("name spans = %v, want %v", g.Spans["name"], want)
+	}
+	if want := "[<b>releas</b>] <b>release</b>"; g.Highlighted["name"] != want {
+		t.Errorf("highlighted name = %q, want %q", g.Highlighted["name"], want)
+	}
+	if g.Highlighted["alias"] != "[x]" {
+		t.Errorf("highlighted alias = %q, want %q", g.Highlighted["alias"], "[x]")
+	}
+	if g.Corrections != 3 {
+		t.Errorf("Corrections = %d, want 3", g.Corrections)
+	}
+}
+
+func TestExpandTermTables(t *testing.T) {
+	db := openTestDB(t)
+	c := ticketCollection(t)
+	if err := c.Create(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Insert(db, Document{"tid": 1, "title": "crash", "body": "on start"}); err != nil {
+		t.Fatal(err)
+	}
+	// Create makes the vocabulary along with the index.
+	got, err := ExpandTerm(db, "ticket", "crsh", DefaultTypoOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Term != "crash" || got[0].Distance != 1 {
+		t.Errorf("ExpandTerm(ticket, crsh) = %+v, want crash at distance 1", got)
+	}
+
+	for _, table := range []string{"nosuch", "contact_vocab; DROP TABLE contact; --"} {
+		if _, err := ExpandTerm(db, table, "crsh", DefaultTypoOptions); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("ExpandTerm(%q) error = %v, want ErrInvalidQuery", table, err)
+		}
+		if err := CreateVocabTable(db, table); err == nil {
+			t.Errorf("CreateVocabTable(%q) succeeded", table)
+		}
+	}
+}
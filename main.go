@@ -3,11 +3,15 @@ package main
 import (
 	"bufio"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"math/rand"
 	"os"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/chrwhy/simple/examples/go/im-search"
 	load_test "github.com/chrwhy/simple/examples/go/load-test"
@@ -16,10 +20,13 @@ import (
 )
 
 func ImSearchInit(db *sql.DB) {
-	im_search.CreateChatGroupTable(db)
-	im_search.CreateGroupMemberTable(db)
-	im_search.CreateChatMessageTable(db)
-	im_search.CreateContactTable(db)
+	// Create or upgrade the tables, FTS5 indexes and the vocabulary tables backing the
+	// typo-tolerant searches. Seeding a database left at an older version would fail, so
+	// stop there.
+	if _, err := im_search.Migrate(db); err != nil {
+		log.Printf("Migrate error: %v", err)
+		return
+	}
 
 	// Seed example chat groups (no-op if already seeded).
 	im_search.SeedChatGroups(db)
@@ -29,6 +36,36 @@ func ImSearchInit(db *sql.DB) {
 	im_search.SeedContacts(db)
 	// Seed example chat messages (no-op if already seeded).
 	im_search.SeedChatMessages(db)
+
+	// Fix group members whose names drifted from their contacts.
+	fixed, err := im_search.ReconcileGroupMembers(db)
+	if err != nil {
+		log.Printf("ReconcileGroupMembers error: %v", err)
+	}
+	for _, d := range fixed {
+		log.Printf("ReconcileGroupMembers: gid=%d uid=%d name %q -> %q, alias %q -> %q", d.Gid, d.Uid, d.Name, d.ContactName, d.Alias, d.ContactAlias)
+	}
+}
+
+// CollectionsInit registers the collections declared in collections.json, creates their
+// tables and returns those it created. A missing file declares no collections.
+func CollectionsInit(db *sql.DB) []*im_search.DocumentCollection {
+	collections, err := im_search.LoadCollections("collections.json")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		log.Printf("LoadCollections error: %v", err)
+	}
+	var created []*im_search.DocumentCollection
+	for _, c := range collections {
+		if err := c.Create(db); err != nil {
+			log.Printf("Create %s error: %v", c.Table(), err)
+			continue
+		}
+		created = append(created, c)
+	}
+	return created
 }
 
 func ExternalSearchInit(db *sql.DB) {
@@ -36,13 +73,26 @@ func ExternalSearchInit(db *sql.DB) {
 	load_test.MockData(db)
 }
 
+func ColumnFilterBenchmark(db *sql.DB) {
+	load_test.CreateMemberBenchTable(db)
+	load_test.MockMemberData(db, 1000000)
+	load_test.BenchmarkColumnFilter(db, []string{"james", "mary OR john", "smith AND robert", "wil*"}, 20)
+}
+
 func main() {
 	db := util.InitDB()
 	defer db.Close()
+	// The REPL shows what im_search reports without failing, such as skipped seed rows,
+	// and how qparser tokenizes queries.
+	im_search.Logger = log.Default()
+	qparser.Logger = log.Default()
 
 	//ImSearchInit(db)
 	//ExternalSearchInit(db)
+	//ColumnFilterBenchmark(db)
 	//spotlight.InitData(db)
+	var collections []*im_search.DocumentCollection
+	//collections = CollectionsInit(db)
 
 	reader := bufio.NewReader(os.Stdin)
 	fmt.Println("Simple SQL REPL")
@@ -53,7 +103,8 @@ func main() {
 		fmt.Println("1. Insert record")
 		fmt.Println("2. Query Mode")
 		fmt.Println("3. SQL Mode")
-		fmt.Println("4. Exit")
+		fmt.Println("4. Schema migrations")
+		fmt.Println("5. Exit")
 		fmt.Print("Enter choice: ")
 		choice, _ := reader.ReadString('\n')
 		choice = strings.TrimSpace(choice)
@@ -85,49 +136,51 @@ func main() {
 				}
 
 				clause := qparser.ParseClause(query)
-				sql := "select biz_id, simple_highlight(t1, 1, '[', ']') from t1 where text match ('" + clause + "')"
-				log.Println(sql)
-				util.Query(db, sql)
+				sql := "select biz_id, simple_highlight(t1, 1, '[', ']') from t1 where text match ?"
+				log.Println(sql, clause)
+				util.Query(db, sql, clause)
 
-				log.Println(strings.Repeat("=", 60))
-				log.Println(">>>>>>>>>> Chat Groups")
-				a, _ := im_search.SearchChatGroups(db, clause)
-				if len(a) != 0 {
-					log.Println(a)
-				} else {
-					log.Println("(no results)")
+				res, err := im_search.SearchAll(db, query, im_search.SearchAllOptions{Highlight: im_search.DefaultHighlightOptions})
+				if err != nil {
+					log.Printf("SearchAll error: %v", err)
 				}
-				log.Println()
-
-				log.Println(strings.Repeat("=", 60))
-				log.Println(">>>>>>>>>> Chat Messages")
-				b, _ := im_search.SearchChatMessages(db, query)
-				if len(b) != 0 {
-					log.Println(b)
-				} else {
-					log.Println("(no results)")
-				}
-				log.Println()
-
-				log.Println(strings.Repeat("=", 60))
-				log.Println(">>>>>>>>>> Contacts")
-				c, _ := im_search.SearchContacts(db, clause)
-				if len(c) != 0 {
-					log.Println(c)
-				} else {
-					log.Println("(no results)")
-				}
-				log.Println()
-
-				log.Println(strings.Repeat("=", 60))
-				log.Println(">>>>>>>>>> Group Members")
-				d, _ := im_search.SearchGroupMembers(db, clause)
-				if len(d) != 0 {
-					log.Println(d)
-				} else {
-					log.Println("(no results)")
+				printCategory("Chat Groups", res.ChatGroups.Total, res.ChatGroups.Took, len(res.ChatGroups.Hits), func(i int) string {
+					h := res.ChatGroups.Hits[i]
+					return fmt.Sprintf("gid=%d name=%s alias=%s", h.Gid, h.Highlighted["name"], h.Highlighted["alias"])
+				})
+				printCategory("Chat Messages", res.ChatMessages.Total, res.ChatMessages.Took, len(res.ChatMessages.Hits), func(i int) string {
+					h := res.ChatMessages.Hits[i]
+					return fmt.Sprintf("cid=%d %s:%d %s", h.Cid, h.SubjectType, h.SubjectId, h.Highlighted["message"])
+				})
+				printCategory("Contacts", res.Contacts.Total, res.Contacts.Took, len(res.Contacts.Hits), func(i int) string {
+					h := res.Contacts.Hits[i]
+					return fmt.Sprintf("uid=%d name=%s alias=%s", h.Uid, h.Highlighted["name"], h.Highlighted["alias"])
+				})
+				printCategory("Group Members", res.GroupMembers.Total, res.GroupMembers.Took, len(res.GroupMembers.Hits), func(i int) string {
+					h := res.GroupMembers.Hits[i]
+					return fmt.Sprintf("gid=%d uid=%d name=%s alias=%s alias_in_group=%s", h.Gid, h.Uid, h.Highlighted["name"], h.Highlighted["alias"], h.Highlighted["alias_in_group"])
+				})
+				for _, c := range collections {
+					t0 := time.Now()
+					p, err := c.Search(db, query, im_search.DefaultHighlightOptions, im_search.SearchOptions{})
+					if err != nil {
+						log.Printf("Search %s error: %v", c.Table(), err)
+					}
+					printCategory(c.Table(), p.Total, time.Since(t0), len(p.Hits), func(i int) string {
+						h := p.Hits[i]
+						fields := make([]string, 0, len(h.Value))
+						for name, v := range h.Value {
+							if hl, ok := h.Highlighted[name]; ok {
+								v = hl
+							}
+							fields = append(fields, fmt.Sprintf("%s=%v", name, v))
+						}
+						sort.Strings(fields)
+						return strings.Join(fields, " ")
+					})
 				}
 				log.Println(strings.Repeat("=", 60))
+				log.Printf("SearchAll cost: %v", res.Took)
 			}
 		case "3":
 			for {
@@ -144,6 +197,8 @@ func main() {
 				util.Query(db, query)
 			}
 		case "4":
+			MigrationMode(db, reader)
+		case "5":
 			fmt.Println("Exiting...")
 			return
 		default:
@@ -152,6 +207,53 @@ func main() {
 	}
 }
 
+// MigrationMode shows the schema version and the pending migrations of db, and applies
+// them once confirmed.
+func MigrationMode(db *sql.DB, reader *bufio.Reader) {
+	version, err := im_search.SchemaVersion(db)
+	if err != nil {
+		log.Printf("SchemaVersion error: %v", err)
+		return
+	}
+	fmt.Printf("Schema version: %d\n", version)
+	pending, err := im_search.PendingMigrations(db)
+	if err != nil {
+		log.Printf("PendingMigrations error: %v", err)
+		return
+	}
+	if len(pending) == 0 {
+		fmt.Println("No pending migrations.")
+		return
+	}
+	for _, m := range pending {
+		fmt.Printf("  pending %d: %s\n", m.Version, m.Name)
+	}
+	fmt.Print("Apply pending migrations? (y/N): ")
+	answer, _ := reader.ReadString('\n')
+	if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+		return
+	}
+	applied, err := im_search.Migrate(db)
+	for _, m := range applied {
+		fmt.Printf("  applied %d: %s\n", m.Version, m.Name)
+	}
+	if err != nil {
+		fmt.Printf("Migration failed, database left at the last applied version: %v\n", err)
+	}
+}
+
+func printCategory(title string, total int, took time.Duration, n int, line func(i int) string) {
+	log.Println(strings.Repeat("=", 60))
+	log.Printf(">>>>>>>>>> %s (%d total, %v)", title, total, took)
+	if n == 0 {
+		log.Println("(no results)")
+	}
+	for i := 0; i < n; i++ {
+		log.Println(line(i))
+	}
+	log.Println()
+}
+
 func InsertRecord(db *sql.DB, bizId int, text string) {
 	if bizId <= 0 {
 		bizId = rand.Int()
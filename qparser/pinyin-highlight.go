@@ -0,0 +1,190 @@
+package qparser
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode"
+)
+
+// DefaultHanziPinyinDict is the dictionary HanziPinyin loads when none was loaded, found
+// in the root of this module's source tree. Binaries run away from the source should call
+// LoadHanziPinyin with a path of their own.
+const DefaultHanziPinyinDict = "cn_pinyin.dict"
+
+// Span marks a highlighted range of a string, counted in runes.
+type Span struct {
+	Start  int
+	Length int
+}
+
+var (
+	hanziPinyin     atomic.Pointer[map[rune][]string]
+	hanziPinyinOnce sync.Once
+)
+
+// defaultHanziPinyinPath returns the path of DefaultHanziPinyinDict in the module root.
+func defaultHanziPinyinPath() string {
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		return DefaultHanziPinyinDict
+	}
+	return filepath.Join(filepath.Dir(file), "..", DefaultHanziPinyinDict)
+}
+
+// LoadHanziPinyin loads a dictionary of lines like "长=chang,zhang" mapping every hanzi
+// to its pinyin readings. It replaces any dictionary loaded before and is safe to call
+// while HanziPinyin runs.
+func LoadHanziPinyin(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	m := make(map[rune][]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		hanzi := []rune(key)
+		if !ok || len(hanzi) != 1 || value == "" {
+			continue
+		}
+		m[hanzi[0]] = append(m[hanzi[0]], strings.Split(value, ",")...)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	hanziPinyin.Store(&m)
+	return nil
+}
+
+// HanziPinyin returns the pinyin readings of r, loading DefaultHanziPinyinDict on first use.
+func HanziPinyin(r rune) []string {
+	hanziPinyinOnce.Do(func() {
+		if hanziPinyin.Load() != nil {
+			return
+		}
+		if err := LoadHanziPinyin(defaultHanziPinyinPath()); err != nil {
+			logf("LoadHanziPinyin error: %v", err)
+		}
+	})
+	m := hanziPinyin.Load()
+	if m == nil {
+		return nil
+	}
+	return (*m)[r]
+}
+
+// MatchPinyinSpans returns the runes of text matched by query, where every query token may
+// spell a run of hanzi by full pinyin, pinyin prefixes or initials ("zs", "zhangs" and
+// "zhangsan" all match 张三), or by the characters themselves.
+// Every matched hanzi gets a span of its own; other matched runes are merged.
+func MatchPinyinSpans(text, query string) []Span {
+	runes := []rune(text)
+	marked := make([]bool, len(runes))
+	for _, token := range strings.Fields(strings.ToLower(query)) {
+		m := pinyinMatcher{text: runes, q: []rune(token), memo: make(map[[2]int]int)}
+		for start := 0; start < len(runes); start++ {
+			if unicode.IsSpace(runes[start]) {
+				continue
+			}
+			if end := m.match(start, 0); end > start {
+				for i := start; i < end; i++ {
+					marked[i] = true
+				}
+				start = end - 1
+			}
+		}
+	}
+
+	var spans []Span
+	for i := 0; i < len(runes); i++ {
+		if !marked[i] {
+			continue
+		}
+		if n := len(spans); n > 0 && !unicode.Is(unicode.Han, runes[i]) {
+			last := &spans[n-1]
+			prev := last.Start + last.Length - 1
+			if prev == i-1 && !unicode.Is(unicode.Han, runes[prev]) {
+				last.Length++
+				continue
+			}
+		}
+		spans = append(spans, Span{Start: i, Length: 1})
+	}
+	return spans
+}
+
+// HighlightPinyin wraps the spans found by MatchPinyinSpans in open and close,
+// e.g. HighlightPinyin("张三", "zs", "[", "]") returns "[张][三]".
+func HighlightPinyin(text, query, open, close string) string {
+	return ApplySpans(text, MatchPinyinSpans(text, query), open, close)
+}
+
+// ApplySpans wraps every span of text in open and close. Spans must be sorted and disjoint.
+func ApplySpans(text string, spans []Span, open, close string) string {
+	if len(spans) == 0 {
+		return text
+	}
+	runes := []rune(text)
+	var b strings.Builder
+	pos := 0
+	for _, s := range spans {
+		b.WriteString(string(runes[pos:s.Start]))
+		b.WriteString(open)
+		b.WriteString(string(runes[s.Start : s.Start+s.Length]))
+		b.WriteString(close)
+		pos = s.Start + s.Length
+	}
+	b.WriteString(string(runes[pos:]))
+	return b.String()
+}
+
+// pinyinMatcher matches the query token q against text. Readings sharing prefixes let
+// q[qi:] be tried from the same ti along many paths, so every result is memoized.
+type pinyinMatcher struct {
+	text, q []rune
+	memo    map[[2]int]int
+}
+
+// match reports the end of the text runes consumed when q[qi:] matches text from ti,
+// or -1 when it does not match.
+func (m *pinyinMatcher) match(ti, qi int) int {
+	if qi == len(m.q) {
+		return ti
+	}
+	if ti == len(m.text) {
+		return -1
+	}
+	key := [2]int{ti, qi}
+	if end, ok := m.memo[key]; ok {
+		return end
+	}
+	end := m.matchFrom(ti, qi)
+	m.memo[key] = end
+	return end
+}
+
+func (m *pinyinMatcher) matchFrom(ti, qi int) int {
+	r := m.text[ti]
+	if unicode.ToLower(r) == m.q[qi] {
+		if end := m.match(ti+1, qi+1); end >= 0 {
+			return end
+		}
+	}
+	for _, py := range HanziPinyin(r) {
+		for k := min(len(py), len(m.q)-qi); k > 0; k-- {
+			if string(m.q[qi:qi+k]) == py[:k] {
+				if end := m.match(ti+1, qi+k); end >= 0 {
+					return end
+				}
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,35 @@
+package qparser
+
+import (
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestHanziPinyinLoadsDefaultDict(t *testing.T) {
+	// Tests run in the package directory, where DefaultHanziPinyinDict does not exist.
+	if got := HanziPinyin('张'); !slices.Contains(got, "zhang") {
+		t.Errorf("HanziPinyin('张') = %q, want zhang among them", got)
+	}
+}
+
+func TestLoadHanziPinyinWhileReading(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := LoadHanziPinyin(defaultHanziPinyinPath()); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			HanziPinyin('长')
+		}()
+	}
+	wg.Wait()
+	if got := HanziPinyin('长'); !slices.Contains(got, "chang") {
+		t.Errorf("HanziPinyin('长') = %q, want chang among them", got)
+	}
+}
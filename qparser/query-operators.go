@@ -0,0 +1,87 @@
+package qparser
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// DateLayout is the layout of before: and after: values.
+const DateLayout = "2006-01-02"
+
+// Operators holds the filters typed inline in a query, like
+// "from:张三 in:开发组 after:2026-01-01 review".
+type Operators struct {
+	From   []string  // sender names, contacts or group members, by hanzi or pinyin
+	In     []string  // conversation names, groups or contacts, by hanzi or pinyin
+	Before time.Time // before:D keeps messages sent before the start of day D
+	After  time.Time // after:D keeps messages sent from the start of day D on
+}
+
+// IsZero reports whether no operator was given.
+func (o Operators) IsZero() bool {
+	return len(o.From) == 0 && len(o.In) == 0 && o.Before.IsZero() && o.After.IsZero()
+}
+
+// ParseOperators extracts from:, in:, before: and after: operators from query and returns
+// them with the remaining keywords. Values may be double-quoted to contain spaces, as in
+// in:"产品 讨论". Repeated from: or in: operators match any of their values. Dates use
+// DateLayout in the local time zone; an invalid date is an error.
+// Any other word containing ':' is kept as a keyword.
+func ParseOperators(query string) (Operators, string, error) {
+	var ops Operators
+	var rest []string
+	for _, token := range splitQuoted(query) {
+		key, value, ok := strings.Cut(token, ":")
+		value = strings.Trim(value, `"`)
+		if !ok || value == "" {
+			rest = append(rest, token)
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "from":
+			ops.From = append(ops.From, value)
+		case "in":
+			ops.In = append(ops.In, value)
+		case "before", "after":
+			day, err := time.ParseInLocation(DateLayout, value, time.Local)
+			if err != nil {
+				return ops, "", fmt.Errorf("invalid %s: date %q, want %s", key, value, DateLayout)
+			}
+			if strings.ToLower(key) == "before" {
+				ops.Before = day
+			} else {
+				ops.After = day
+			}
+		default:
+			rest = append(rest, token)
+		}
+	}
+	return ops, strings.Join(rest, " "), nil
+}
+
+// splitQuoted splits s on whitespace outside double quotes.
+func splitQuoted(s string) []string {
+	var tokens []string
+	var current strings.Builder
+	quoted := false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			current.WriteRune(r)
+		case unicode.IsSpace(r) && !quoted:
+			if current.Len() > 0 {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		tokens = append(tokens, current.String())
+	}
+	return tokens
+}
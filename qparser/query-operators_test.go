@@ -0,0 +1,55 @@
+package qparser
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseOperators(t *testing.T) {
+	day := func(s string) time.Time {
+		d, err := time.ParseInLocation(DateLayout, s, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	tests := []struct {
+		query   string
+		want    Operators
+		rest    string
+		wantErr bool
+	}{
+		{query: "review", rest: "review"},
+		{query: "from:张三 in:开发组 after:2026-01-01 review",
+			want: Operators{From: []string{"张三"}, In: []string{"开发组"}, After: day("2026-01-01")}, rest: "review"},
+		{query: `in:"产品 讨论" from:"li si" plan`,
+			want: Operators{From: []string{"li si"}, In: []string{"产品 讨论"}}, rest: "plan"},
+		{query: "FROM:bob Before:2026-02-01", want: Operators{From: []string{"bob"}, Before: day("2026-02-01")}},
+		{query: "from:bob from:alice in:dev in:ops",
+			want: Operators{From: []string{"bob", "alice"}, In: []string{"dev", "ops"}}},
+		{query: "after:2026-01-01 after:2026-03-01", want: Operators{After: day("2026-03-01")}},
+		{query: `"meet from:bob" at noon`, rest: `"meet from:bob" at noon`},
+		{query: `"from:bob"`, rest: `"from:bob"`},
+		{query: "from: to:me http://x", rest: "from: to:me http://x"},
+		{query: "before:2026-13-01", wantErr: true},
+		{query: "review after:yesterday", wantErr: true},
+		{query: "before:2026/01/01", wantErr: true},
+	}
+	for _, tt := range tests {
+		ops, rest, err := ParseOperators(tt.query)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseOperators(%q) error = %v, want error %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if !reflect.DeepEqual(ops, tt.want) {
+			t.Errorf("ParseOperators(%q) = %+v, want %+v", tt.query, ops, tt.want)
+		}
+		if rest != tt.rest {
+			t.Errorf("ParseOperators(%q) rest = %q, want %q", tt.query, rest, tt.rest)
+		}
+	}
+}
@@ -14,6 +14,16 @@ const (
 	SubPinyinStopSign = 3
 )
 
+// Logger receives how queries are tokenized and dictionary load errors. It is nil by
+// default, which discards them.
+var Logger *log.Logger
+
+func logf(format string, args ...any) {
+	if Logger != nil {
+		Logger.Printf(format, args...)
+	}
+}
+
 func IsAllEn(query string) bool {
 	for _, r := range []rune(query) {
 		if !(r >= 'A' && r <= 'Z') && !(r >= 'a' && r <= 'z') {
@@ -62,7 +72,9 @@ func ParseClause(query string) string {
 
 	for _, token := range regroupedTokens {
 		if IsAllEn(token) {
-			log.Printf("Token: %s, Pinyin result: %v", token, pinyin.Parse(token))
+			if Logger != nil {
+				logf("Token: %s, Pinyin result: %v", token, pinyin.Parse(token))
+			}
 			pinyinClause := ParsePinyinClause(token)
 			partialSql := ""
 			if len(clause) > 0 {
@@ -76,9 +88,9 @@ func ParseClause(query string) string {
 			clause = clause + partialSql
 			//log.Println(partialSql)
 		} else {
+			// The clause is bound as a MATCH parameter, so only FTS5 string quoting applies.
 			token = strings.Replace(token, "\"", "\"\"", -1)
-			token = strings.Replace(token, "'", "''", -1)
-			log.Printf("Token: %s", token)
+			logf("Token: %s", token)
 			sql := `("` + token + `")`
 			if len(clause) > 0 {
 				clause = clause + " AND " + sql
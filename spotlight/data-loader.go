@@ -1,6 +1,7 @@
 package spotlight
 
 import (
+	"context"
 	"database/sql"
 	"log"
 	"math/rand"
@@ -8,6 +9,15 @@ import (
 )
 
 func InitData(db *sql.DB) {
+	if err := InitDataContext(context.Background(), db); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Records inserted successfully")
+}
+
+// InitDataContext is InitData with a context. It returns the first insert error, which is
+// the context's error once ctx is done.
+func InitDataContext(ctx context.Context, db *sql.DB) error {
 	records := []string{
 		"周杰伦 Jay Chou: \"最美的不是下雨天，是曾与你躲过雨的屋檐\"",
 		"I love China! 我爱中国!",
@@ -34,50 +44,75 @@ func InitData(db *sql.DB) {
 	}
 
 	for i, record := range records {
-		InsertRecord(db, i+1, record)
+		if err := InsertRecordContext(ctx, db, i+1, record); err != nil {
+			return err
+		}
 	}
-	log.Println("Records inserted successfully")
 
 	//LoadFilesystemData(db, "/")
+	return nil
 }
 
 func LoadFilesystemData(db *sql.DB, path string) {
-	err := ReadDirRecursive(db, path)
+	err := LoadFilesystemDataContext(context.Background(), db, path)
 	if err != nil {
 		log.Fatalf("Error walking the directory: %v", err)
 	}
 }
 
+// LoadFilesystemDataContext is LoadFilesystemData with a context. It returns the error that
+// stopped the walk, which is the context's error once ctx is done.
+func LoadFilesystemDataContext(ctx context.Context, db *sql.DB, path string) error {
+	return ReadDirRecursiveContext(ctx, db, path)
+}
+
 func ReadDirRecursive(db *sql.DB, dir string) error {
+	return ReadDirRecursiveContext(context.Background(), db, dir)
+}
+
+// ReadDirRecursiveContext is ReadDirRecursive with a context; the walk stops with the
+// context's error once ctx is done.
+func ReadDirRecursiveContext(ctx context.Context, db *sql.DB, dir string) error {
 	entries, err := os.ReadDir(dir)
 	if err != nil && !os.IsPermission(err) {
 		return err
 	}
 
 	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		path := dir + "/" + entry.Name()
 		if entry.IsDir() {
 			// Recursively read subdirectory
-			err := ReadDirRecursive(db, path)
+			err := ReadDirRecursiveContext(ctx, db, path)
 			if err != nil {
 				return err
 			}
 		} else {
 			//log.Println(entry.Name())
-			InsertRecord(db, 0, path)
+			if err := InsertRecordContext(ctx, db, 0, path); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
 func InsertRecord(db *sql.DB, bizId int, text string) {
+	if err := InsertRecordContext(context.Background(), db, bizId, text); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// InsertRecordContext is InsertRecord with a context, returning the insert error instead
+// of exiting; cancelling ctx interrupts the insert.
+func InsertRecordContext(ctx context.Context, db *sql.DB, bizId int, text string) error {
 	if bizId <= 0 {
 		bizId = rand.Int()
 	}
 	insertSQL := `INSERT INTO t1(biz_id, text) VALUES (?, ?)`
-	_, err := db.Exec(insertSQL, bizId, text)
-	if err != nil {
-		log.Fatal(err)
-	}
+	_, err := db.ExecContext(ctx, insertSQL, bizId, text)
 	//log.Println("Records inserted successfully")
+	return err
 }
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
@@ -30,9 +31,14 @@ func InitDB() *sql.DB {
 	return db
 }
 
-func Query(db *sql.DB, querySQL string) {
+func Query(db *sql.DB, querySQL string, args ...any) {
+	QueryContext(context.Background(), db, querySQL, args...)
+}
+
+// QueryContext is Query with a context; cancelling ctx interrupts the running statement.
+func QueryContext(ctx context.Context, db *sql.DB, querySQL string, args ...any) {
 	t0 := time.Now()
-	rows, err := db.Query(querySQL)
+	rows, err := db.QueryContext(ctx, querySQL, args...)
 	log.Println("Query cost: ", time.Since(t0))
 	if err != nil {
 		log.Printf("query error: %v with sql: %s", err, querySQL)